@@ -0,0 +1,228 @@
+package recipe
+
+import (
+	"fmt"
+)
+
+/*
+ * Builder
+ *
+ * Recipes can be assembled from Go code instead of loading them from a
+ * file. They are checked with the same rules before running them.
+ */
+
+type Option func(r *Recipe) error
+
+// NewRecipe creates an empty recipe. Unless other ones are given with the
+// options, it logs with a default logger and keeps its state in memory.
+func NewRecipe(opts ...Option) (*Recipe, error) {
+	r := &Recipe{
+		Tasks: make(map[string]*Task),
+		dir:   ".",
+	}
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+	if r.logger == nil {
+		r.logger = NewLogger("[Recipe] ")
+	}
+	if r.state == nil {
+		r.state = NewState(r.logger)
+	}
+	if r.timings == nil {
+		r.timings = NewTimings(r.logger)
+	}
+	if r.fingerprints == nil {
+		r.fingerprints = NewFingerprints(r.logger)
+	}
+	/* The logger may be set by an option after WithCache */
+	if r.cache != nil && r.cache.logger == nil {
+		r.cache.logger = r.logger
+	}
+	return r, nil
+}
+
+func WithLogger(logger *Logger) Option {
+	return func(r *Recipe) error {
+		r.logger = logger
+		return nil
+	}
+}
+
+// WithState uses a state previously created with NewState or OpenState.
+func WithState(state *State) Option {
+	return func(r *Recipe) error {
+		r.state = state
+		return nil
+	}
+}
+
+// WithStateFile keeps the state in path, loading it if it already exists.
+func WithStateFile(path string, logger *Logger) Option {
+	return func(r *Recipe) error {
+		state, err := OpenState(path, logger)
+		if err != nil {
+			return err
+		}
+		r.state = state
+		return nil
+	}
+}
+
+// WithMemoryState keeps the state only in memory.
+func WithMemoryState(logger *Logger) Option {
+	return WithState(NewState(logger))
+}
+
+// WithTimingsFile keeps the durations of the tasks in path, loading them if
+// it already exists.
+func WithTimingsFile(path string, logger *Logger) Option {
+	return func(r *Recipe) error {
+		timings, err := OpenTimings(path, logger)
+		if err != nil {
+			return err
+		}
+		r.timings = timings
+		return nil
+	}
+}
+
+// WithFingerprintsFile keeps the fingerprints of the tasks with outputs in
+// path, loading them if it already exists.
+func WithFingerprintsFile(path string, logger *Logger) Option {
+	return func(r *Recipe) error {
+		fingerprints, err := OpenFingerprints(path, logger)
+		if err != nil {
+			return err
+		}
+		r.fingerprints = fingerprints
+		return nil
+	}
+}
+
+// WithCache stores the outputs of the tasks in the cache in dir. A maxSize
+// of zero means no limit.
+func WithCache(dir string, maxSize int64) Option {
+	return func(r *Recipe) error {
+		r.cache = NewCache(dir, maxSize, nil)
+		return nil
+	}
+}
+
+// WithOrder selects the order used to dispatch the ready tasks.
+func WithOrder(o Order) Option {
+	return func(r *Recipe) error {
+		r.order = o
+		return nil
+	}
+}
+
+// WithKeepGoing keeps running the tasks that do not depend on a failed one,
+// as SetKeepGoing does.
+func WithKeepGoing() Option {
+	return func(r *Recipe) error {
+		r.keepGoing = true
+		return nil
+	}
+}
+
+func WithMain(names ...string) Option {
+	return func(r *Recipe) error {
+		r.Main = Targets(names)
+		return nil
+	}
+}
+
+func WithEnv(env map[string]string) Option {
+	return func(r *Recipe) error {
+		r.Env = env
+		return nil
+	}
+}
+
+func WithInterp(interp ...string) Option {
+	return func(r *Recipe) error {
+		r.Interp = interp
+		return nil
+	}
+}
+
+func WithVars(vars map[string]string) Option {
+	return func(r *Recipe) error {
+		r.Vars = vars
+		return nil
+	}
+}
+
+// WithVar overrides the value of a variable, as SetVar does. Given to Open
+// or Parse, it can define variables that the recipe does not declare.
+func WithVar(name, value string) Option {
+	return func(r *Recipe) error {
+		if !varNameRegexp.MatchString(name) {
+			return fmt.Errorf("Invalid variable name: %s", name)
+		}
+		r.SetVar(name, value)
+		return nil
+	}
+}
+
+// WithResources sets the amount of every resource that the tasks can
+// require.
+func WithResources(resources map[string]int) Option {
+	return func(r *Recipe) error {
+		r.Resources = resources
+		return nil
+	}
+}
+
+// WithDir sets the directory used to find included recipes and as the
+// value of {recipe_dir}.
+func WithDir(dir string) Option {
+	return func(r *Recipe) error {
+		r.dir = dir
+		return nil
+	}
+}
+
+// AddTask adds a task to the recipe. It fails if there is already a task
+// with the same name.
+func (r *Recipe) AddTask(name string, t *Task) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name == "" {
+		return fmt.Errorf("Empty task name")
+	}
+	if t == nil {
+		return fmt.Errorf("In task '%s': Nil task", name)
+	}
+	if _, ok := r.Tasks[name]; ok {
+		return fmt.Errorf("In task '%s': Already defined", name)
+	}
+	if r.Tasks == nil {
+		r.Tasks = make(map[string]*Task)
+	}
+	t.name = name
+	r.Tasks[name] = t
+	r.checked = false
+	return nil
+}
+
+// Check builds the final list of tasks, as it is done when loading a file,
+// and validates the recipe. It is called before running the recipe if it
+// has changed since the last time.
+func (r *Recipe) Check() error {
+	if err := r.resolve(r.dir, nil); err != nil {
+		return err
+	}
+	if err := r.check(); err != nil {
+		return err
+	}
+	r.checked = true
+	return nil
+}
+
+func (r *Recipe) State() *State {
+	return r.state
+}
@@ -0,0 +1,128 @@
+package recipe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecipe_builder(t *testing.T) {
+	/* Create tmp file */
+	name := "builder_output.txt"
+	defer os.Remove(name)
+
+	logger := NewLogger("[Test] ")
+	logger.Level = WarningL
+	r, err := NewRecipe(
+		WithLogger(logger),
+		WithMemoryState(logger),
+		WithMain("t1"),
+		WithInterp("bash", "-c", "exec {cmd}"),
+		WithVars(map[string]string{"out": name}),
+	)
+	if err != nil {
+		t.Errorf("Creating recipe: %s", err)
+		return
+	}
+	err = r.AddTask("t1", &Task{Deps: []string{"t2", "t3"}, Cmd: "echo {task} >> {out}"})
+	if err != nil {
+		t.Errorf("Adding task: %s", err)
+		return
+	}
+	err = r.AddTask("t2", &Task{Deps: []string{"t4"}, Cmd: "echo {task} >> {out}"})
+	if err != nil {
+		t.Errorf("Adding task: %s", err)
+		return
+	}
+	if err := r.AddTask("t5", nil); err == nil {
+		t.Error("Expected nil task")
+	}
+	err = r.AddTask("t2", &Task{})
+	if err == nil {
+		t.Error("Expected duplicated task")
+		return
+	}
+
+	/* Use the same rules than the recipes in files */
+	err = r.Check()
+	if err == nil || !strings.Contains(err.Error(), "Unknown referenced task: t") {
+		t.Errorf("Expected unknown tasks, not %v", err)
+		return
+	}
+	err = r.AddTask("t3", &Task{Extends: "t2", Deps: []string{}})
+	if err != nil {
+		t.Errorf("Adding task: %s", err)
+		return
+	}
+	err = r.AddTask("t4", &Task{Cmd: "echo {task} >> {out}"})
+	if err != nil {
+		t.Errorf("Adding task: %s", err)
+		return
+	}
+
+	/* Run recipe */
+	err = r.RunMain(1)
+	if err != nil {
+		t.Errorf("Running recipe: %s", err)
+		return
+	}
+
+	/* Check tmp file */
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Errorf("Reading output: %s", err)
+		return
+	}
+	lines := strings.Split(string(data), "\n")
+	if !(len(lines) == 5 && lines[3] == "t1" && lines[4] == "") {
+		t.Errorf("Invalid data: %s", data)
+	}
+	if !(r.State().IsSuccess("t1") && r.State().IsSuccess("t2") && r.State().IsSuccess("t3") && r.State().IsSuccess("t4")) {
+		t.Errorf("Wrong state: %v", r.State().String())
+	}
+}
+
+/* The cache gets the logger of the recipe, even when it is set after it */
+func TestRecipe_builderCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := NewRecipe(
+		WithCache(filepath.Join(dir, "cache"), 600),
+		WithLogger(logger),
+		WithMain("t"),
+		WithInterp("bash", "-c", "{cmd}"),
+		WithVars(map[string]string{"dir": dir}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Cache().logger != logger {
+		t.Fatal("The cache does not use the logger of the recipe")
+	}
+	tasks := map[string]*Task{
+		"t":  {Deps: []string{"t1", "t2"}},
+		"t1": {Cmd: "head -c 500 /dev/zero > {dir}/t1", Outputs: []string{"{dir}/t1"}},
+		"t2": {Cmd: "head -c 500 /dev/zero | tr '\\0' a > {dir}/t2", Outputs: []string{"{dir}/t2"}},
+	}
+	for n, task := range tasks {
+		if err := r.AddTask(n, task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	/* Both outputs do not fit, so every run prunes the cache */
+	for i := 0; i < 2; i++ {
+		if err := r.RunMain(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size, err := r.Cache().Size(); err != nil || size > 600 {
+		t.Errorf("The cache was not pruned: %d, %v", size, err)
+	}
+}
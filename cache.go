@@ -0,0 +1,405 @@
+package recipe
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Output cache
+ *
+ * When the recipe has a cache directory, the outputs of the tasks that
+ * succeed are stored in it, keyed by the fingerprints of their command and
+ * the content of their inputs. A task that is not up to date, but whose key
+ * is in the cache, is not run: its outputs are restored, and its captured
+ * stdout and stderr are written again.
+ *
+ * The content of the files is stored once, in blobs named by their hash,
+ * and each entry lists the blobs of a task. When the cache grows bigger
+ * than its maximum size, the least recently used entries are removed after
+ * each run, or with Prune.
+ */
+
+/* Maximum size of the cache if the recipe does not give one */
+const defaultCacheMaxSize = 1 << 30
+
+// Cache is a directory with the outputs of the tasks.
+type Cache struct {
+	Dir     string
+	MaxSize int64
+	logger  *Logger
+}
+
+// NewCache uses the cache in dir, which is created when the first entry is
+// stored. A maxSize of zero means no limit.
+func NewCache(dir string, maxSize int64, logger *Logger) *Cache {
+	return &Cache{
+		Dir:     dir,
+		MaxSize: maxSize,
+		logger:  logger,
+	}
+}
+
+// SetCache stores the outputs of the tasks in c, instead of the cache of
+// the recipe. A nil cache disables it.
+func (r *Recipe) SetCache(c *Cache) {
+	r.cache = c
+}
+
+// Cache returns the cache of the recipe, or nil if it has none.
+func (r *Recipe) Cache() *Cache {
+	return r.cache
+}
+
+/* The cache given by the recipe, relative to its directory */
+func (r *Recipe) openCache() *Cache {
+	if r.CacheDir == "" {
+		return nil
+	}
+	dir := r.CacheDir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(r.dir, dir)
+	}
+	maxSize := int64(defaultCacheMaxSize)
+	if r.CacheMaxSize != "" {
+		maxSize, _ = ParseSize(r.CacheMaxSize)
+	}
+	return NewCache(dir, maxSize, r.logger)
+}
+
+// ParseSize parses sizes like "512MB" or "2GB", in multiples of 1024
+// bytes. A number without unit is a number of bytes.
+func ParseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	number, unit := strings.TrimSpace(strings.ToUpper(s)), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(number, u.suffix) {
+			number, unit = strings.TrimSpace(strings.TrimSuffix(number, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size: %s", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+/* The key of the outputs of a run with the given fingerprint */
+func cacheKey(fp *Fingerprint) string {
+	sum := sha256.Sum256([]byte(fp.Command + "\x00" + fp.Inputs))
+	return hex.EncodeToString(sum[:])
+}
+
+/* Output of a task, copied while it is written to its destination */
+type capturedOutput struct {
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+}
+
+/* Restores the outputs of the task, if they are in the cache */
+func (r *Recipe) restoreCached(n string, et *expandedTask, fp *Fingerprint) bool {
+	key := cacheKey(fp)
+	e, err := r.cache.entry(key)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			r.logger.Warning("Unable to read the cache entry of '%s': %s", n, err.Error())
+		}
+		return false
+	}
+	if err := r.cache.restore(e, et); err != nil {
+		r.logger.Warning("Unable to restore '%s' from the cache: %s", n, err.Error())
+		return false
+	}
+	/* Entries are removed by when they were last used */
+	now := time.Now()
+	os.Chtimes(r.cache.entryPath(key), now, now)
+	r.logger.Info("Restored from cache: %s", n)
+	return true
+}
+
+/* Stores the outputs of the task, if every one of them exists */
+func (r *Recipe) storeCached(n string, et *expandedTask, fp *Fingerprint, output *capturedOutput) {
+	files, ok := existingOutputs(et.outputs)
+	if !ok {
+		r.logger.Warning("Not caching '%s': Missing outputs", n)
+		return
+	}
+	if err := r.cache.store(cacheKey(fp), n, files, output); err != nil {
+		r.logger.Warning("Unable to cache '%s': %s", n, err.Error())
+		return
+	}
+	r.logger.Debug("Cached: %s", n)
+}
+
+/* Removes the oldest entries if the cache is too big */
+func (r *Recipe) trimCache() {
+	if r.cache == nil || r.cache.MaxSize == 0 {
+		return
+	}
+	if _, err := r.cache.Prune(r.cache.MaxSize); err != nil {
+		r.logger.Warning("Unable to prune the cache: %s", err.Error())
+	}
+}
+
+/***
+ * Entries and blobs
+ */
+
+type cacheEntry struct {
+	Task    string       `json:"task"`
+	Outputs []cachedFile `json:"outputs"`
+	Stdout  string       `json:"stdout"`
+	Stderr  string       `json:"stderr"`
+}
+
+type cachedFile struct {
+	Path string      `json:"path"`
+	Mode os.FileMode `json:"mode"`
+	Blob string      `json:"blob"`
+}
+
+func (c *Cache) entryPath(key string) string {
+	return filepath.Join(c.Dir, "entries", key+".json")
+}
+
+func (c *Cache) blobPath(hash string) string {
+	return filepath.Join(c.Dir, "blobs", hash[:2], hash)
+}
+
+func (c *Cache) entry(key string) (*cacheEntry, error) {
+	b, err := ioutil.ReadFile(c.entryPath(key))
+	if err != nil {
+		return nil, err
+	}
+	e := &cacheEntry{}
+	if err := json.Unmarshal(b, e); err != nil {
+		return nil, err
+	}
+	for _, blob := range e.blobs() {
+		if len(blob) != sha256.Size*2 {
+			return nil, fmt.Errorf("Invalid blob: %q", blob)
+		}
+	}
+	return e, nil
+}
+
+func (c *Cache) store(key, taskName string, outputs []string, output *capturedOutput) error {
+	e := &cacheEntry{Task: taskName, Outputs: []cachedFile{}}
+	for _, o := range outputs {
+		err := filepath.Walk(o, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			hash, err := c.storeFile(path)
+			if err != nil {
+				return err
+			}
+			e.Outputs = append(e.Outputs, cachedFile{path, info.Mode().Perm(), hash})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	var err error
+	if e.Stdout, err = c.storeBlob(output.stdout.Bytes()); err != nil {
+		return err
+	}
+	if e.Stderr, err = c.storeBlob(output.stderr.Bytes()); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.entryPath(key), append(b, '\n'), 0644)
+}
+
+func (c *Cache) storeFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return c.storeBlob(data)
+}
+
+/* Stores the data once, named by its hash */
+func (c *Cache) storeBlob(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	path := c.blobPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+	return hash, writeFileAtomic(path, data, 0644)
+}
+
+func (c *Cache) restore(e *cacheEntry, et *expandedTask) error {
+	/* Check every blob before changing any file */
+	for _, f := range append([]cachedFile{{Blob: e.Stdout}, {Blob: e.Stderr}}, e.Outputs...) {
+		if _, err := os.Stat(c.blobPath(f.Blob)); err != nil {
+			return err
+		}
+	}
+	for _, f := range e.Outputs {
+		data, err := ioutil.ReadFile(c.blobPath(f.Blob))
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(f.Path, data, f.Mode); err != nil {
+			return err
+		}
+	}
+	if err := c.replay(e.Stdout, et.stdout, os.Stdout); err != nil {
+		return err
+	}
+	return c.replay(e.Stderr, et.stderr, os.Stderr)
+}
+
+/* Writes a captured output to its file, or to w if it has none */
+func (c *Cache) replay(blob, path string, w io.Writer) error {
+	data, err := ioutil.ReadFile(c.blobPath(blob))
+	if err != nil {
+		return err
+	}
+	if path != "" {
+		return ioutil.WriteFile(path, data, 0644)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+/* Writes a file through a temporary one, so it is never seen half written */
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+/***
+ * Pruning
+ */
+
+// Size returns the size of the blobs stored in the cache.
+func (c *Cache) Size() (int64, error) {
+	size := int64(0)
+	err := c.walkBlobs(func(hash string, info os.FileInfo) error {
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// Prune removes the least recently used entries until the cache is not
+// bigger than maxSize, and then the blobs that no entry uses. It returns
+// the number of removed entries.
+func (c *Cache) Prune(maxSize int64) (int, error) {
+	blobSizes := make(map[string]int64)
+	err := c.walkBlobs(func(hash string, info os.FileInfo) error {
+		blobSizes[hash] = info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	infos, err := ioutil.ReadDir(filepath.Join(c.Dir, "entries"))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	/* The most recently used first */
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+
+	used := make(map[string]bool)
+	size, removed := int64(0), 0
+	for _, info := range infos {
+		key := strings.TrimSuffix(info.Name(), ".json")
+		if info.IsDir() || key == info.Name() {
+			continue
+		}
+		e, err := c.entry(key)
+		entrySize := int64(0)
+		if err == nil {
+			for _, blob := range e.blobs() {
+				if !used[blob] {
+					entrySize += blobSizes[blob]
+				}
+			}
+		}
+		if err != nil || size+entrySize > maxSize {
+			if err := os.Remove(c.entryPath(key)); err != nil {
+				return removed, err
+			}
+			removed++
+			c.logger.Debug("Removing cache entry: %s", key)
+			continue
+		}
+		size += entrySize
+		for _, blob := range e.blobs() {
+			used[blob] = true
+		}
+	}
+	for hash := range blobSizes {
+		if !used[hash] {
+			if err := os.Remove(c.blobPath(hash)); err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+func (e *cacheEntry) blobs() []string {
+	blobs := []string{e.Stdout, e.Stderr}
+	for _, f := range e.Outputs {
+		blobs = append(blobs, f.Blob)
+	}
+	return blobs
+}
+
+func (c *Cache) walkBlobs(fn func(hash string, info os.FileInfo) error) error {
+	root := filepath.Join(c.Dir, "blobs")
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return err
+		}
+		return fn(info.Name(), info)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package recipe
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* The outputs of the tasks are restored from the cache */
+func TestRecipe_cache(t *testing.T) {
+	txt := `
+interp = ['bash', '-c', '{cmd}']
+cache = "%[1]s/cache"
+
+[tasks.copy]
+inputs = ["%[1]s/a.in"]
+outputs = ["%[1]s/out"]
+stdout = "%[1]s/stdout.txt"
+cmd = "mkdir -p %[1]s/out; cp %[1]s/a.in %[1]s/out/a.txt; cat %[1]s/a.in; echo run >> %[1]s/log"
+`
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Parse(strings.NewReader(fmt.Sprintf(txt, dir)), TOML, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := 0
+	run := func(input string, expected bool) {
+		path := filepath.Join(dir, "a.in")
+		if err := ioutil.WriteFile(path, []byte(input), 0644); err != nil {
+			t.Fatal(err)
+		}
+		future := time.Now().Add(time.Duration(runs+1) * time.Hour)
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.RunTask("copy", testWorkers()); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "log"))
+		ran := strings.Count(string(data), "run") > runs
+		if ran {
+			runs++
+		}
+		if ran != expected {
+			t.Errorf("With %s: expected to run %v, not %v", input, expected, ran)
+		}
+		if !r.state.IsSuccess("copy") {
+			t.Errorf("With %s: expected Success, not %s", input, r.state.States["copy"])
+		}
+		for _, name := range []string{"out/a.txt", "stdout.txt"} {
+			if data, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(data) != input {
+				t.Errorf("With %s: invalid %s: %q", input, name, data)
+			}
+		}
+	}
+
+	run("a", true)
+	run("b", true)
+	/* Back to a, which is in the cache */
+	os.RemoveAll(filepath.Join(dir, "out"))
+	run("a", false)
+	run("b", false)
+	r.SetForce(true)
+	run("a", true)
+	r.SetForce(false)
+
+	if _, err := r.Cache().Prune(0); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := r.Cache().Size(); err != nil || size != 0 {
+		t.Errorf("Expected an empty cache, not %d bytes (%v)", size, err)
+	}
+	run("b", true)
+}
+
+func TestRecipe_cachePrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewCache(dir, 0, NewLogger("[Test] "))
+	/* Each entry has an output of 100 bytes, and the same empty stdout and stderr */
+	for i, key := range []string{"k1", "k2", "k3"} {
+		out := filepath.Join(dir, key)
+		if err := ioutil.WriteFile(out, bytes.Repeat([]byte{byte('a' + i)}, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.store(key, key, []string{out}, &capturedOutput{}); err != nil {
+			t.Fatal(err)
+		}
+		used := time.Now().Add(time.Duration(i) * time.Minute)
+		os.Chtimes(c.entryPath(key), used, used)
+	}
+	if size, err := c.Size(); err != nil || size != 300 {
+		t.Errorf("Expected 300 bytes, not %d (%v)", size, err)
+	}
+	removed, err := c.Prune(250)
+	if err != nil || removed != 1 {
+		t.Errorf("Expected to remove 1 entry, not %d (%v)", removed, err)
+	}
+	if _, err := c.entry("k1"); !os.IsNotExist(err) {
+		t.Errorf("Expected k1 to be removed, not %v", err)
+	}
+	if size, err := c.Size(); err != nil || size != 200 {
+		t.Errorf("Expected 200 bytes, not %d (%v)", size, err)
+	}
+
+	for s, expected := range map[string]int64{"100": 100, "1KB": 1024, "1.5 mb": 3 << 19, "2GB": 2 << 30} {
+		if size, err := ParseSize(s); err != nil || size != expected {
+			t.Errorf("Expected %s to be %d, not %d (%v)", s, expected, size, err)
+		}
+	}
+	if _, err := ParseSize("-1MB"); err == nil {
+		t.Error("Expected an invalid size")
+	}
+}
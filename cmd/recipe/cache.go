@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/Kerrigan29a/recipe"
+)
+
+func cacheCommand(args []string) int {
+	usage := func() {
+		fmt.Printf("Usage of %s cache:\n", os.Args[0])
+		fmt.Printf("  %s cache prune [flags] recipe...\n\n", os.Args[0])
+		fmt.Printf("Manage the output cache of the recipes.\n")
+	}
+	if len(args) == 0 || args[0] != "prune" {
+		usage()
+		return 1
+	}
+	return cachePruneCommand(args[1:])
+}
+
+func cachePruneCommand(args []string) int {
+	flags := flag.NewFlagSet("cache prune", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("Usage of %s cache prune:\n", os.Args[0])
+		fmt.Printf("  %s cache prune [flags] recipe...\n\n", os.Args[0])
+		fmt.Printf("Remove the least recently used entries of the cache of the recipes until it fits in its maximum size.\n\n")
+		flags.PrintDefaults()
+	}
+	var formatName, maxSizeName string
+	all := flags.Bool("all", false, "Remove every entry")
+	flags.StringVar(&maxSizeName, "max-size", "", "Maximum size, like 500MB, instead of the cache_max_size of the recipe")
+	flags.StringVar(&formatName, "format", "", "Format of the recipe read from stdin (json, toml or yaml). By default it is guessed")
+	flags.Parse(args)
+	paths := flags.Args()
+	if len(paths) <= 0 {
+		fmt.Fprintf(os.Stderr, "Must supply a recipe file, or - to read it from stdin\n\n")
+		flags.Usage()
+		return 1
+	}
+	format, ok := parseFormatFlag(formatName)
+	if !ok {
+		flags.Usage()
+		return 1
+	}
+	maxSize := int64(-1)
+	if maxSizeName != "" {
+		var err error
+		if maxSize, err = recipe.ParseSize(maxSizeName); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n\n", err.Error())
+			flags.Usage()
+			return 1
+		}
+	}
+	if *all {
+		maxSize = 0
+	}
+
+	logger := recipe.NewLogger("[Cache ] ")
+	logger.Level = recipe.ErrorL
+	status := 0
+	for _, path := range paths {
+		r, err := open(path, format, logger, logger, nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			status = 1
+			continue
+		}
+		c := r.Cache()
+		if c == nil {
+			fmt.Fprintf(os.Stderr, "%s: No cache\n", path)
+			status = 1
+			continue
+		}
+		limit := c.MaxSize
+		if maxSize >= 0 {
+			limit = maxSize
+		} else if limit == 0 {
+			/* The cache of the recipe has no limit */
+			limit = math.MaxInt64
+		}
+		removed, err := c.Prune(limit)
+		if err == nil {
+			var size int64
+			size, err = c.Size()
+			fmt.Printf("%s: Removed %d entries, %d bytes left in %s\n", path, removed, size, c.Dir)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			status = 1
+		}
+	}
+	return status
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Kerrigan29a/recipe"
+)
+
+func checkCommand(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("Usage of %s check:\n", os.Args[0])
+		fmt.Printf("  %s check [flags] recipe...\n\n", os.Args[0])
+		fmt.Printf("Validate the recipes without running them.\n\n")
+		flags.PrintDefaults()
+	}
+	var formatName string
+	quiet := flags.Bool("q", false, "Only show the problems")
+	flags.StringVar(&formatName, "format", "", "Format of the recipe read from stdin (json, toml or yaml). By default it is guessed")
+	flags.Parse(args)
+	paths := flags.Args()
+	if len(paths) <= 0 {
+		fmt.Fprintf(os.Stderr, "Must supply a recipe file, or - to read it from stdin\n\n")
+		flags.Usage()
+		return 1
+	}
+	format := recipe.ParseFormat(formatName)
+	if formatName != "" && format == recipe.UnknownFormat {
+		fmt.Fprintf(os.Stderr, "Unknown format: %s\n\n", formatName)
+		flags.Usage()
+		return 1
+	}
+
+	/* Warnings are shown, as they are problems that do not make the recipe invalid */
+	logger := recipe.NewLogger("[Check ] ")
+	logger.Level = recipe.WarningL
+	status := 0
+	for _, path := range paths {
+		var err error
+		if path == "-" {
+			_, err = recipe.Parse(os.Stdin, format, logger, logger)
+			if err != nil {
+				err = stdinError(err)
+			}
+		} else {
+			err = recipe.CheckFile(path, logger)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			status = 1
+		} else if !*quiet {
+			fmt.Printf("%s: OK\n", path)
+		}
+	}
+	return status
+}
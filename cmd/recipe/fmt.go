@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/Kerrigan29a/recipe"
+)
+
+func fmtCommand(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("Usage of %s fmt:\n", os.Args[0])
+		fmt.Printf("  %s fmt [flags] recipe...\n\n", os.Args[0])
+		fmt.Printf("Rewrite the recipes in their canonical style. A recipe read from stdin is written to stdout.\n\n")
+		flags.PrintDefaults()
+	}
+	var formatName string
+	check := flags.Bool("check", false, "Do not rewrite the recipes, but list the ones that are not formatted and fail")
+	flags.StringVar(&formatName, "format", "", "Format of the recipe read from stdin (json, toml or yaml). By default it is guessed")
+	flags.Parse(args)
+	paths := flags.Args()
+	if len(paths) <= 0 {
+		fmt.Fprintf(os.Stderr, "Must supply a recipe file, or - to read it from stdin\n\n")
+		flags.Usage()
+		return 1
+	}
+	stdinFormat, ok := parseFormatFlag(formatName)
+	if !ok {
+		flags.Usage()
+		return 1
+	}
+
+	status := 0
+	for _, path := range paths {
+		data, format, err := readRecipe(path, stdinFormat)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			status = 1
+			continue
+		}
+		formatted, err := recipe.FormatRecipe(data, format)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, pathError(path, err).Error())
+			status = 1
+			continue
+		}
+		switch {
+		case *check:
+			if !bytes.Equal(data, formatted) {
+				fmt.Println(displayName(path))
+				status = 1
+			}
+		case path == "-":
+			os.Stdout.Write(formatted)
+		case !bytes.Equal(data, formatted):
+			if err := writeRecipe(path, formatted); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				status = 1
+			}
+		}
+	}
+	return status
+}
+
+func convertCommand(args []string) int {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("Usage of %s convert:\n", os.Args[0])
+		fmt.Printf("  %s convert [flags] recipe\n\n", os.Args[0])
+		fmt.Printf("Convert a recipe to another format, in its canonical style.\n\n")
+		flags.PrintDefaults()
+	}
+	var formatName, toName, output string
+	flags.StringVar(&formatName, "format", "", "Format of the recipe read from stdin (json, toml or yaml). By default it is guessed")
+	flags.StringVar(&toName, "to", "", "Format of the converted recipe (json, toml or yaml). By default it is guessed from the output file")
+	flags.StringVar(&output, "o", "-", "Output file, or - to write to stdout")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Must supply a recipe file, or - to read it from stdin\n\n")
+		flags.Usage()
+		return 1
+	}
+	stdinFormat, ok := parseFormatFlag(formatName)
+	if !ok {
+		flags.Usage()
+		return 1
+	}
+	to := recipe.ParseFormat(toName)
+	if toName == "" {
+		to = recipe.FormatFromPath(output)
+	}
+	if to == recipe.UnknownFormat {
+		fmt.Fprintf(os.Stderr, "Unknown output format: %s\n\n", toName)
+		flags.Usage()
+		return 1
+	}
+
+	path := flags.Arg(0)
+	data, format, err := readRecipe(path, stdinFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	converted, err := recipe.Convert(data, format, to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, pathError(path, err).Error())
+		return 1
+	}
+	if output == "-" {
+		os.Stdout.Write(converted)
+		return 0
+	}
+	if err := writeRecipe(output, converted); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
+
+func parseFormatFlag(name string) (recipe.Format, bool) {
+	format := recipe.ParseFormat(name)
+	if name != "" && format == recipe.UnknownFormat {
+		fmt.Fprintf(os.Stderr, "Unknown format: %s\n\n", name)
+		return format, false
+	}
+	return format, true
+}
+
+/* Reads a recipe and guesses its format, as it is done when running it */
+func readRecipe(path string, stdinFormat recipe.Format) ([]byte, recipe.Format, error) {
+	if path == "-" {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, recipe.UnknownFormat, stdinError(err)
+		}
+		if stdinFormat == recipe.UnknownFormat {
+			stdinFormat = recipe.SniffFormat(data)
+		}
+		return data, stdinFormat, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, recipe.UnknownFormat, fmt.Errorf("(%s) %w", path, err)
+	}
+	format := recipe.FormatFromPath(path)
+	if format == recipe.UnknownFormat {
+		format = recipe.SniffFormat(data)
+	}
+	return data, format, nil
+}
+
+func writeRecipe(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode()
+	}
+	if err := ioutil.WriteFile(path, data, mode); err != nil {
+		return fmt.Errorf("(%s) %w", path, err)
+	}
+	return nil
+}
+
+func pathError(path string, err error) error {
+	if path == "-" {
+		return stdinError(err)
+	}
+	var ds recipe.Diagnostics
+	if errors.As(err, &ds) {
+		for i := range ds {
+			if ds[i].File == "" {
+				ds[i].File = path
+			}
+		}
+		return err
+	}
+	return fmt.Errorf("(%s) %w", path, err)
+}
+
+func displayName(path string) string {
+	if path == "-" {
+		return "stdin"
+	}
+	return path
+}
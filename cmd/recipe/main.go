@@ -1,32 +1,96 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Kerrigan29a/recipe"
 )
 
 var version string
 
-func parseArgs(task *string, numWorkers *uint, level *recipe.LoggerLevel) []string {
+/* Subcommands, selected by the first argument */
+var commands = map[string]func(args []string) int{
+	"cache":   cacheCommand,
+	"check":   checkCommand,
+	"convert": convertCommand,
+	"fmt":     fmtCommand,
+	"plan":    planCommand,
+}
+
+type varsFlag map[string]string
+
+func (v varsFlag) String() string {
+	pairs := make([]string, 0, len(v))
+	for name, value := range v {
+		pairs = append(pairs, name+"="+value)
+	}
+	return strings.Join(pairs, " ")
+}
+
+func (v varsFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("Expected name=value, not %s", s)
+	}
+	v[parts[0]] = parts[1]
+	return nil
+}
+
+type tasksFlag []string
+
+func (t *tasksFlag) String() string {
+	return strings.Join(*t, " ")
+}
+
+func (t *tasksFlag) Set(s string) error {
+	if s == "" {
+		return fmt.Errorf("Empty task name")
+	}
+	*t = append(*t, s)
+	return nil
+}
+
+func parseArgs(tasks *tasksFlag, numWorkers *uint, level *recipe.LoggerLevel, format *recipe.Format, order *recipe.Order, keepGoing, dryRun, force *bool, deadline *time.Duration, vars varsFlag) []string {
 	flag.Usage = func() {
 		fmt.Printf("Usage of %s:\n", os.Args[0])
+		fmt.Printf("  %s [flags] recipe...\n", os.Args[0])
+		fmt.Printf("  %s check [flags] recipe...\n", os.Args[0])
+		fmt.Printf("  %s fmt [flags] recipe...\n", os.Args[0])
+		fmt.Printf("  %s plan [flags] recipe...\n", os.Args[0])
+		fmt.Printf("  %s cache prune [flags] recipe...\n", os.Args[0])
+		fmt.Printf("  %s convert [flags] recipe\n\n", os.Args[0])
 		flag.PrintDefaults()
 		fmt.Println("")
 		fmt.Printf("Version: %s\n", version)
 	}
 	var verbose, quiet bool
+	var formatName, orderName string
 	flag.UintVar(numWorkers, "w", uint(runtime.NumCPU()), "Amount of workers")
-	flag.StringVar(task, "m", "", "Main task")
+	flag.Var(tasks, "m", "Main task, instead of the ones of the recipe. Can be repeated")
 	flag.BoolVar(&verbose, "v", false, "Show more information")
 	flag.BoolVar(&quiet, "q", false, "Show less information")
+	flag.Var(vars, "D", "Override a variable with name=value. Can be repeated")
+	flag.StringVar(&formatName, "format", "", "Format of the recipe read from stdin (json, toml or yaml). By default it is guessed")
+	flag.BoolVar(dryRun, "n", false, "Show what would be run, as the plan command, instead of running it")
+	flag.BoolVar(force, "B", false, "Run the tasks even if their outputs are up to date")
+	flag.BoolVar(force, "force", false, "Same as -B")
+	flag.BoolVar(keepGoing, "k", false, "Keep running the tasks that do not depend on a failed one")
+	flag.BoolVar(keepGoing, "keep-going", false, "Same as -k")
+	flag.DurationVar(deadline, "deadline", 0, "Maximum duration of each run, like 30m, instead of the deadline of the recipe")
+	flag.StringVar(&orderName, "order", "critical", "Order of the ready tasks: critical (longest chain first) or name")
 	flag.Parse()
 	paths := flag.Args()
 	if len(paths) <= 0 {
-		fmt.Fprintf(os.Stderr, "Must supply a recipe file\n\n")
+		fmt.Fprintf(os.Stderr, "Must supply a recipe file, or - to read it from stdin\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -35,6 +99,19 @@ func parseArgs(task *string, numWorkers *uint, level *recipe.LoggerLevel) []stri
 		flag.Usage()
 		os.Exit(1)
 	}
+	*format = recipe.ParseFormat(formatName)
+	if formatName != "" && *format == recipe.UnknownFormat {
+		fmt.Fprintf(os.Stderr, "Unknown format: %s\n\n", formatName)
+		flag.Usage()
+		os.Exit(1)
+	}
+	var err error
+	*order, err = recipe.ParseOrder(orderName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n\n", err.Error())
+		flag.Usage()
+		os.Exit(1)
+	}
 	if verbose {
 		*level = recipe.DebugL
 	} else if quiet {
@@ -46,10 +123,21 @@ func parseArgs(task *string, numWorkers *uint, level *recipe.LoggerLevel) []stri
 }
 
 func main() {
-	var task string
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
+	var tasks tasksFlag
 	var numWorkers uint
 	var level recipe.LoggerLevel
-	paths := parseArgs(&task, &numWorkers, &level)
+	var format recipe.Format
+	var order recipe.Order
+	var keepGoing, dryRun, force bool
+	var deadline time.Duration
+	vars := make(varsFlag)
+	paths := parseArgs(&tasks, &numWorkers, &level, &format, &order, &keepGoing, &dryRun, &force, &deadline, vars)
 	logger := recipe.NewLogger("[ Main ] ")
 	logger.Level = level
 	recipeLogger := recipe.NewLogger("[Recipe] ")
@@ -57,18 +145,64 @@ func main() {
 	stateLogger := recipe.NewLogger("[State ] ")
 	stateLogger.Level = level
 	logger.Info("Version: %s", version)
+
+	/* Terminate the running tasks when interrupted, and die with the next signal */
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
 	for _, path := range paths {
-		recipe, err := recipe.Open(path, recipeLogger, stateLogger)
+		recipe, err := open(path, format, recipeLogger, stateLogger, vars)
 		if err != nil {
 			logger.Fatal(err)
 		}
-		if task == "" {
-			err = recipe.RunMain(numWorkers)
+		recipe.SetOrder(order)
+		recipe.SetKeepGoing(keepGoing)
+		recipe.SetForce(force)
+		if deadline > 0 {
+			recipe.SetDeadline(deadline)
+		}
+		if dryRun {
+			err = printPlan(recipe, tasks, numWorkers, false)
+		} else if len(tasks) == 0 {
+			err = recipe.RunMainContext(ctx, numWorkers)
 		} else {
-			err = recipe.RunTask(task, numWorkers)
+			err = recipe.RunTasksContext(ctx, tasks, numWorkers)
 		}
 		if err != nil {
 			logger.Fatal(err)
 		}
 	}
 }
+
+/* The variables are overridden before checking the recipe, so they can be new ones */
+func open(path string, format recipe.Format, recipeLogger, stateLogger *recipe.Logger, vars varsFlag) (*recipe.Recipe, error) {
+	opts := make([]recipe.Option, 0, len(vars))
+	for name, value := range vars {
+		opts = append(opts, recipe.WithVar(name, value))
+	}
+	if path == "-" {
+		r, err := recipe.Parse(os.Stdin, format, recipeLogger, stateLogger, opts...)
+		if err != nil {
+			return nil, stdinError(err)
+		}
+		return r, nil
+	}
+	return recipe.Open(path, recipeLogger, stateLogger, opts...)
+}
+
+func stdinError(err error) error {
+	var ds recipe.Diagnostics
+	if errors.As(err, &ds) {
+		for i := range ds {
+			if ds[i].File == "" {
+				ds[i].File = "stdin"
+			}
+		}
+		return err
+	}
+	return fmt.Errorf("(stdin) %w", err)
+}
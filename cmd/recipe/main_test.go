@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Kerrigan29a/recipe"
+)
+
+func tmpRecipe(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "recipe*.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+/* The -D variables are known when the recipe is checked */
+func TestOpen_vars(t *testing.T) {
+	path := tmpRecipe(t, `
+main = "t1"
+
+[tasks.t1]
+cmd = "echo {greeting}"
+`)
+	defer os.Remove(path)
+	logger := recipe.NewLogger("[Test] ")
+	logger.Level = recipe.FatalL
+
+	if _, err := open(path, recipe.TOML, logger, logger, nil); err == nil || !strings.Contains(err.Error(), "greeting") {
+		t.Errorf("Expected an undefined variable, not %v", err)
+	}
+
+	vars := varsFlag{}
+	if err := vars.Set("greeting=hello"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := open(path, recipe.TOML, logger, logger, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Vars["greeting"] != "hello" {
+		t.Errorf("Wrong vars: %v", r.Vars)
+	}
+
+	for _, def := range []string{"bad-name=x", "greeting={missing}", "task=x"} {
+		vars := varsFlag{}
+		if err := vars.Set(def); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := open(path, recipe.TOML, logger, logger, vars); err == nil {
+			t.Errorf("Expected an error with -D %s", def)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/Kerrigan29a/recipe"
+)
+
+func planCommand(args []string) int {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("Usage of %s plan:\n", os.Args[0])
+		fmt.Printf("  %s plan [flags] recipe...\n\n", os.Args[0])
+		fmt.Printf("Show what running the recipes would do, without running anything nor changing their state.\n\n")
+		flags.PrintDefaults()
+	}
+	var tasks tasksFlag
+	var formatName, orderName string
+	vars := make(varsFlag)
+	numWorkers := flags.Uint("w", uint(runtime.NumCPU()), "Amount of workers")
+	asJSON := flags.Bool("json", false, "Write the plan as JSON")
+	flags.Var(&tasks, "m", "Main task, instead of the ones of the recipe. Can be repeated")
+	flags.Var(vars, "D", "Override a variable with name=value. Can be repeated")
+	flags.StringVar(&formatName, "format", "", "Format of the recipe read from stdin (json, toml or yaml). By default it is guessed")
+	flags.StringVar(&orderName, "order", "critical", "Order of the ready tasks: critical (longest chain first) or name")
+	flags.Parse(args)
+	paths := flags.Args()
+	if len(paths) <= 0 {
+		fmt.Fprintf(os.Stderr, "Must supply a recipe file, or - to read it from stdin\n\n")
+		flags.Usage()
+		return 1
+	}
+	format, ok := parseFormatFlag(formatName)
+	if !ok {
+		flags.Usage()
+		return 1
+	}
+	order, err := recipe.ParseOrder(orderName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n\n", err.Error())
+		flags.Usage()
+		return 1
+	}
+
+	logger := recipe.NewLogger("[Plan  ] ")
+	logger.Level = recipe.ErrorL
+	status := 0
+	for _, path := range paths {
+		r, err := open(path, format, logger, logger, vars)
+		if err == nil {
+			r.SetOrder(order)
+			err = printPlan(r, tasks, *numWorkers, *asJSON)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			status = 1
+		}
+	}
+	return status
+}
+
+func printPlan(r *recipe.Recipe, tasks []string, numWorkers uint, asJSON bool) error {
+	var plan *recipe.Plan
+	var err error
+	if len(tasks) == 0 {
+		plan, err = r.PlanMain(numWorkers)
+	} else {
+		plan, err = r.PlanTasks(tasks, numWorkers)
+	}
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		os.Stdout.Write(plan.JSON())
+	} else {
+		fmt.Print(plan.String())
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+package recipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"unicode"
+)
+
+/*
+ * Conditions
+ *
+ * A task with run_if only runs when its condition is true, and a task with
+ * skip_if only runs when it is false. Otherwise the task is marked as
+ * Skipped, which satisfies its dependents like a success. A condition is a
+ * command, run with the interpreter and the env of the task, that is true
+ * when it exits with 0, or an expression like ${{ env.CI == 'true' }}.
+ *
+ * The expressions compare strings: the env of the task as env.NAME, the
+ * variables as vars.name, literals quoted with ' or ", and true and false.
+ * They are combined with ==, !=, !, &&, || and parentheses, and a value is
+ * true when it is not empty.
+ */
+
+const (
+	exprPrefix = "${{"
+	exprSuffix = "}}"
+	trueValue  = "true"
+)
+
+/* Returned instead of running a task whose conditions are not met */
+type skippedError struct {
+	reason string
+}
+
+func (e *skippedError) Error() string {
+	return "Skipped: " + e.reason
+}
+
+func isExpression(cond string) bool {
+	cond = strings.TrimSpace(cond)
+	return strings.HasPrefix(cond, exprPrefix) && strings.HasSuffix(cond, exprSuffix)
+}
+
+func (r *Recipe) checkConditions(n string, t *Task) error {
+	for _, c := range []struct{ field, cond string }{{"run_if", t.RunIf}, {"skip_if", t.SkipIf}} {
+		if !isExpression(c.cond) {
+			continue
+		}
+		_, refs, err := parseExpression(c.cond)
+		if err != nil {
+			return fmt.Errorf("In task '%s': Invalid %s: %s", n, c.field, err.Error())
+		}
+		for _, v := range refs {
+			if _, ok := r.taskVars(t)[v]; !ok && !isBuiltinVar(v) {
+				return fmt.Errorf("In task '%s': Undefined variable in %s: %s", n, c.field, v)
+			}
+		}
+	}
+	return nil
+}
+
+/* Returns a skippedError when the conditions of the task are not met */
+func (t *Task) evalConditions(ctx context.Context, r *Recipe, et *expandedTask) error {
+	if et.runIf != "" {
+		ok, err := t.evalCondition(ctx, r, et, et.runIf)
+		if err != nil {
+			return fmt.Errorf("Unable to evaluate run_if: %w", err)
+		}
+		if !ok {
+			return &skippedError{"run_if is false"}
+		}
+	}
+	if et.skipIf != "" {
+		ok, err := t.evalCondition(ctx, r, et, et.skipIf)
+		if err != nil {
+			return fmt.Errorf("Unable to evaluate skip_if: %w", err)
+		}
+		if ok {
+			return &skippedError{"skip_if is true"}
+		}
+	}
+	return nil
+}
+
+func (t *Task) evalCondition(ctx context.Context, r *Recipe, et *expandedTask, cond string) (bool, error) {
+	if isExpression(cond) {
+		expr, _, err := parseExpression(cond)
+		if err != nil {
+			return false, err
+		}
+		env := environMap(t.composeEnv(et))
+		value, err := expr(func(kind, name string) (string, error) {
+			if kind == "env" {
+				return env[name], nil
+			}
+			return et.vars.lookup(name)
+		})
+		return value != "", err
+	}
+
+	t.mu.RLock()
+	parts := t.composeInterpreterCmd(cond, et)
+	t.mu.RUnlock()
+	path, err := exec.LookPath(parts[0])
+	if err != nil {
+		return false, err
+	}
+	/* Terminated like the cmd, when reaching the timeout or after a failure */
+	cmd := exec.Command(path, parts[1:]...)
+	cmd.Env = t.composeEnv(et)
+	err = t.runProcess(ctx, r, cmd)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+/* The last value of every variable in an environment list */
+func environMap(environ []string) map[string]string {
+	env := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return env
+}
+
+/***
+ * Expressions
+ */
+
+type exprLookup func(kind, name string) (string, error)
+
+type expression func(lookup exprLookup) (string, error)
+
+/* Parses an expression, and returns the variables it references */
+func parseExpression(cond string) (expression, []string, error) {
+	cond = strings.TrimSpace(cond)
+	cond = strings.TrimSuffix(strings.TrimPrefix(cond, exprPrefix), exprSuffix)
+	tokens, err := tokenizeExpression(cond)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, nil, fmt.Errorf("Unexpected %s", p.tokens[p.pos])
+	}
+	return expr, p.refs, nil
+}
+
+func tokenizeExpression(s string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case strings.HasPrefix(s[i:], "==") || strings.HasPrefix(s[i:], "!=") ||
+			strings.HasPrefix(s[i:], "&&") || strings.HasPrefix(s[i:], "||"):
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		case c == '!':
+			tokens = append(tokens, "!")
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated string: %s", s[i:])
+			}
+			tokens = append(tokens, s[i:i+end+2])
+			i += end + 2
+		case isIdentChar(rune(c)):
+			start := i
+			for i < len(s) && (isIdentChar(rune(s[i])) || s[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, s[start:i])
+		default:
+			return nil, fmt.Errorf("Unexpected character: %c", c)
+		}
+	}
+	return tokens, nil
+}
+
+func isIdentChar(c rune) bool {
+	return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+	refs   []string
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) parseOr() (expression, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logical(left, right, true)
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (expression, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = logical(left, right, false)
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (expression, error) {
+	if p.peek() != "!" {
+		return p.parseComparison()
+	}
+	p.pos++
+	operand, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	return func(lookup exprLookup) (string, error) {
+		v, err := operand(lookup)
+		return boolValue(v == ""), err
+	}, nil
+}
+
+func (p *exprParser) parseComparison() (expression, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	if op != "==" && op != "!=" {
+		return left, nil
+	}
+	p.pos++
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	return func(lookup exprLookup) (string, error) {
+		l, err := left(lookup)
+		if err != nil {
+			return "", err
+		}
+		r, err := right(lookup)
+		if err != nil {
+			return "", err
+		}
+		return boolValue((l == r) == (op == "==")), nil
+	}, nil
+}
+
+func (p *exprParser) parsePrimary() (expression, error) {
+	tok := p.peek()
+	p.pos++
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("Unexpected end of expression")
+	case tok == "(":
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("Expected )")
+		}
+		p.pos++
+		return expr, nil
+	case tok[0] == '\'' || tok[0] == '"':
+		value := tok[1 : len(tok)-1]
+		return func(exprLookup) (string, error) { return value, nil }, nil
+	case tok == "true" || tok == "false":
+		value := boolValue(tok == "true")
+		return func(exprLookup) (string, error) { return value, nil }, nil
+	case strings.HasPrefix(tok, "env.") || strings.HasPrefix(tok, "vars."):
+		parts := strings.SplitN(tok, ".", 2)
+		kind, name := parts[0], parts[1]
+		if name == "" || strings.Contains(name, ".") {
+			return nil, fmt.Errorf("Invalid name: %s", tok)
+		}
+		if kind == "vars" {
+			p.refs = append(p.refs, name)
+		}
+		return func(lookup exprLookup) (string, error) { return lookup(kind, name) }, nil
+	}
+	return nil, fmt.Errorf("Unexpected %s", tok)
+}
+
+/* && and || short-circuit, so the right side is only evaluated if needed */
+func logical(left, right expression, or bool) expression {
+	return func(lookup exprLookup) (string, error) {
+		l, err := left(lookup)
+		if err != nil {
+			return "", err
+		}
+		if (l != "") == or {
+			return boolValue(or), nil
+		}
+		r, err := right(lookup)
+		return boolValue(r != ""), err
+	}
+}
+
+func boolValue(b bool) string {
+	if b {
+		return trueValue
+	}
+	return ""
+}
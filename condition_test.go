@@ -0,0 +1,88 @@
+package recipe
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+/* The tasks whose conditions are not met are skipped */
+func TestRecipe_conditions(t *testing.T) {
+	txt := `
+main = "t"
+interp = ['bash', '-c', '{cmd}']
+
+[vars]
+mode = "debug"
+
+[tasks.t]
+deps = ["a", "b", "c", "d", "e"]
+cmd = "echo t >> %[1]s"
+
+[tasks.a]
+env = {FOO = "yes"}
+run_if = "${{ env.FOO == 'yes' }}"
+cmd = "echo a >> %[1]s"
+
+[tasks.b]
+skip_if = "${{ vars.mode == 'debug' && !env.RECIPE_UNDEFINED }}"
+cmd = "echo b >> %[1]s"
+
+[tasks.c]
+run_if = "[ {mode} = release ]"
+cmd = "echo c >> %[1]s"
+
+[tasks.d]
+skip_if = "exit 1"
+cmd = "echo d >> %[1]s"
+
+[tasks.e]
+deps = ["b"]
+cmd = "echo e >> %[1]s"
+`
+	name := "conditions_output.txt"
+	defer os.Remove(name)
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Parse(strings.NewReader(fmt.Sprintf(txt, name)), TOML, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RunMain(testWorkers()); err != nil {
+		t.Fatal(err)
+	}
+	/* The skipped tasks satisfy their dependents */
+	if lines := sortedLines(t, name); lines != "a d e t" {
+		t.Errorf("Invalid data: %s", lines)
+	}
+	if !(r.state.IsSuccess("a") && r.state.IsSkipped("b") && r.state.IsSkipped("c") && r.state.IsSuccess("d")) {
+		t.Errorf("Wrong state: %v", r.state.String())
+	}
+}
+
+func TestRecipe_conditionsCheck(t *testing.T) {
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	for cond, expected := range map[string]string{
+		"${{ env.FOO == }}":        "5:1: In task 't1': Invalid run_if: Unexpected end of expression",
+		"${{ env.FOO = 'x' }}":     "5:1: In task 't1': Invalid run_if: Unexpected character: =",
+		"${{ (vars.mode }}":        "5:1: In task 't1': Invalid run_if: Expected )",
+		"${{ vars.undefined }}":    "5:1: In task 't1': Undefined variable in run_if: undefined",
+		"${{ vars.task == 't1' }}": "",
+	} {
+		_, err := Parse(strings.NewReader(fmt.Sprintf(`
+[vars]
+mode = "debug"
+
+[tasks.t1]
+run_if = %q
+cmd = "true"
+`, cond)), TOML, logger, logger)
+		if expected == "" && err != nil {
+			t.Errorf("Expected a valid condition, not %v", err)
+		} else if expected != "" && (err == nil || err.Error() != expected) {
+			t.Errorf("Expected %q, not %v", expected, err)
+		}
+	}
+}
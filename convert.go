@@ -0,0 +1,776 @@
+package recipe
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+ * Formatting and conversion
+ *
+ * Recipes are written back from their tree of nodes, so they look the same
+ * whatever format they come from: the keys of Recipe and Task follow the
+ * order of their fields, the keys of every other table are sorted and null
+ * values are dropped. The comments placed in their own lines are kept
+ * before the key that follows them, and the comments at the end of the line
+ * are moved above it, as every format can write them there. YAML aliases
+ * and merge keys are expanded when converting to other formats, but YAML
+ * recipes using them are not formatted, as they would be lost.
+ */
+
+var recipeType = reflect.TypeOf(Recipe{})
+
+// FormatRecipe rewrites a recipe in the canonical style of its format.
+func FormatRecipe(data []byte, format Format) ([]byte, error) {
+	return Convert(data, format, format)
+}
+
+// Convert rewrites a recipe in another format, using its canonical style.
+// When from is UnknownFormat it is sniffed from the content.
+func Convert(data []byte, from, to Format) ([]byte, error) {
+	if from == UnknownFormat {
+		from = SniffFormat(data)
+	}
+	n, err := parseNode(data, from)
+	if err != nil {
+		return nil, err
+	}
+	if ds := validateNode(n, recipeType); len(ds) > 0 {
+		return nil, ds
+	}
+	if from == YAML && to == YAML {
+		if ds := yamlReferences(data); len(ds) > 0 {
+			return nil, ds
+		}
+	}
+	if err := n.attachComments(data, from); err != nil {
+		return nil, err
+	}
+	if from != to {
+		/* A modeline would no longer tell the right format */
+		n.dropComments(isModeline)
+	}
+	n = canonicalNode(n, recipeType, 0)
+	switch to {
+	case JSON:
+		return encodeJSON(n), nil
+	case TOML:
+		return encodeTOML(n), nil
+	case YAML:
+		return encodeYAML(n)
+	}
+	return nil, errUnknownFormat
+}
+
+func isModeline(comment string) bool {
+	return emacsModeline.MatchString(comment) || vimModeline.MatchString(comment)
+}
+
+/*
+ * Comments
+ */
+
+type comment struct {
+	line   int
+	text   string
+	inline bool // At the end of a line with a key
+}
+
+func (n *node) attachComments(data []byte, format Format) error {
+	switch format {
+	case JSON:
+		n.attachLineComments(scanJSONComments(data))
+	case TOML:
+		n.attachLineComments(scanTOMLComments(data))
+	case YAML:
+		return n.attachYAMLComments(data)
+	}
+	return nil
+}
+
+/*
+ * Every comment goes before the first key found after it, but the comments
+ * at the end of a line go before its first key.
+ */
+func (n *node) attachLineComments(comments []comment) {
+	type keyRef struct {
+		k     *node
+		depth int
+	}
+	keys := make([]keyRef, 0)
+	var collect func(n *node, depth int)
+	collect = func(n *node, depth int) {
+		for i, k := range n.keys {
+			/* Keys of TOML inline tables have no position */
+			if k.line > 0 {
+				keys = append(keys, keyRef{k, depth})
+			}
+			collect(n.items[i], depth+1)
+		}
+		if n.kind == listNode {
+			for _, item := range n.items {
+				collect(item, depth+1)
+			}
+		}
+	}
+	collect(n, 0)
+	/* The keys of a TOML table header share its position, the last one is the closest */
+	sort.SliceStable(keys, func(i, j int) bool {
+		ki, kj := keys[i], keys[j]
+		if ki.k.line != kj.k.line {
+			return ki.k.line < kj.k.line
+		}
+		if ki.k.col != kj.k.col {
+			return ki.k.col < kj.k.col
+		}
+		return ki.depth > kj.depth
+	})
+	i := 0
+	for _, c := range comments {
+		for i < len(keys) && (keys[i].k.line < c.line || keys[i].k.line == c.line && !c.inline) {
+			i++
+		}
+		if i < len(keys) {
+			keys[i].k.comments = append(keys[i].k.comments, c.text)
+		} else {
+			n.trailing = append(n.trailing, c.text)
+		}
+	}
+}
+
+/* Removes the markers of a comment and the space that follows them */
+func commentText(s, marker string) string {
+	s = strings.TrimPrefix(s, marker)
+	s = strings.TrimPrefix(s, " ")
+	return strings.TrimRight(s, " \t\r")
+}
+
+func scanJSONComments(data []byte) []comment {
+	comments := make([]comment, 0)
+	inBlock := false
+	for i, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimSpace(l)
+		block, inline := true, false
+		if inBlock {
+			if end := strings.Index(l, "*/"); end >= 0 {
+				inBlock = false
+				l = l[:end]
+			}
+			l = strings.TrimPrefix(l, "*")
+		} else {
+			start := jsonCommentStart(l)
+			if start < 0 {
+				continue
+			}
+			inline = start > 0
+			l = l[start:]
+			if strings.HasPrefix(l, "//") {
+				block = false
+				l = l[2:]
+			} else {
+				l = l[2:]
+				if end := strings.Index(l, "*/"); end >= 0 {
+					l = l[:end]
+				} else {
+					inBlock = true
+				}
+			}
+		}
+		text := commentText(l, "")
+		/* Skip the lines with just the markers of a block comment */
+		if text == "" && block {
+			continue
+		}
+		comments = append(comments, comment{i + 1, text, inline})
+	}
+	return comments
+}
+
+/* Returns where a comment starts in a line, out of the strings */
+func jsonCommentStart(l string) int {
+	for i := 0; i < len(l); i++ {
+		switch l[i] {
+		case '"':
+			for i++; i < len(l) && l[i] != '"'; i++ {
+				if l[i] == '\\' {
+					i++
+				}
+			}
+		case '/':
+			if strings.HasPrefix(l[i:], "//") || strings.HasPrefix(l[i:], "/*") {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+/* Lines inside multiline strings are never comments */
+func scanTOMLComments(data []byte) []comment {
+	comments := make([]comment, 0)
+	delim := ""
+	for i, l := range strings.Split(string(data), "\n") {
+		rest, continued := l, delim != ""
+		if continued {
+			end := strings.Index(rest, delim)
+			if end < 0 {
+				continue
+			}
+			rest = rest[end+len(delim):]
+		}
+		var start int
+		delim, start = tomlScanLine(rest)
+		if start >= 0 {
+			inline := continued || strings.TrimSpace(rest[:start]) != ""
+			comments = append(comments, comment{i + 1, commentText(rest[start:], "#"), inline})
+		}
+	}
+	return comments
+}
+
+/*
+ * Returns the delimiter of the multiline string left open in a line, and
+ * where its comment starts, if any.
+ */
+func tomlScanLine(l string) (string, int) {
+	for i := 0; i < len(l); i++ {
+		switch l[i] {
+		case '#':
+			return "", i
+		case '"', '\'':
+			q := l[i : i+1]
+			if strings.HasPrefix(l[i:], q+q+q) {
+				end := strings.Index(l[i+3:], q+q+q)
+				if end < 0 {
+					return q + q + q, -1
+				}
+				i += 3 + end + 2
+				continue
+			}
+			for i++; i < len(l) && l[i:i+1] != q; i++ {
+				if q == `"` && l[i] == '\\' {
+					i++
+				}
+			}
+		}
+	}
+	return "", -1
+}
+
+func (n *node) attachYAMLComments(data []byte) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	type position struct{ line, col int }
+	byKey := make(map[position][]string)
+	pending := yamlComments(doc.HeadComment)
+	var walk func(y *yaml.Node)
+	walk = func(y *yaml.Node) {
+		switch y.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(y.Content); i += 2 {
+				k, v := y.Content[i], y.Content[i+1]
+				pos := position{k.Line, k.Column}
+				byKey[pos] = append(byKey[pos], pending...)
+				byKey[pos] = append(byKey[pos], yamlComments(k.HeadComment, k.LineComment, v.HeadComment, v.LineComment)...)
+				pending = nil
+				walk(v)
+				pending = append(pending, yamlComments(v.FootComment, k.FootComment)...)
+			}
+		case yaml.SequenceNode:
+			for _, c := range y.Content {
+				pending = append(pending, yamlComments(c.HeadComment, c.LineComment)...)
+				walk(c)
+				pending = append(pending, yamlComments(c.FootComment)...)
+			}
+		}
+	}
+	for _, c := range doc.Content {
+		pending = append(pending, yamlComments(c.HeadComment, c.LineComment)...)
+		walk(c)
+		pending = append(pending, yamlComments(c.FootComment)...)
+	}
+	pending = append(pending, yamlComments(doc.FootComment)...)
+
+	var assign func(n *node)
+	assign = func(n *node) {
+		for i, k := range n.keys {
+			k.comments = byKey[position{k.line, k.col}]
+			assign(n.items[i])
+		}
+		if n.kind == listNode {
+			for _, item := range n.items {
+				assign(item)
+			}
+		}
+	}
+	assign(n)
+	n.trailing = pending
+	return nil
+}
+
+/* Anchors, aliases and merge keys, which the canonical style can not keep */
+func yamlReferences(data []byte) Diagnostics {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return Diagnostics{{Msg: err.Error(), Err: err}}
+	}
+	ds := Diagnostics{}
+	var walk func(y *yaml.Node)
+	walk = func(y *yaml.Node) {
+		switch {
+		case y.Kind == yaml.AliasNode:
+			ds = append(ds, Diagnostic{Line: y.Line, Column: y.Column, Msg: fmt.Sprintf("Alias *%s can not be kept when formatting", y.Value)})
+			return
+		case y.Anchor != "":
+			ds = append(ds, Diagnostic{Line: y.Line, Column: y.Column, Msg: fmt.Sprintf("Anchor &%s can not be kept when formatting", y.Anchor)})
+		case y.Tag == "!!merge":
+			ds = append(ds, Diagnostic{Line: y.Line, Column: y.Column, Msg: "Merge key can not be kept when formatting"})
+		}
+		for _, c := range y.Content {
+			walk(c)
+		}
+	}
+	walk(&doc)
+	return ds
+}
+
+func yamlComments(blocks ...string) []string {
+	comments := make([]string, 0)
+	for _, b := range blocks {
+		for _, l := range strings.Split(b, "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				comments = append(comments, commentText(l, "#"))
+			}
+		}
+	}
+	return comments
+}
+
+func (n *node) dropComments(drop func(string) bool) {
+	filter := func(comments []string) []string {
+		kept := comments[:0]
+		for _, c := range comments {
+			if !drop(c) {
+				kept = append(kept, c)
+			}
+		}
+		return kept
+	}
+	n.trailing = filter(n.trailing)
+	for i, k := range n.keys {
+		k.comments = filter(k.comments)
+		n.items[i].dropComments(drop)
+	}
+	if n.kind == listNode {
+		for _, item := range n.items {
+			item.dropComments(drop)
+		}
+	}
+}
+
+/*
+ * Canonical order
+ */
+
+func canonicalNode(n *node, t reflect.Type, depth int) *node {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch n.kind {
+	case mapNode:
+		type entry struct {
+			k, v  *node
+			name  string
+			order int
+		}
+		var fields map[string]reflect.StructField
+		if t.Kind() == reflect.Struct {
+			fields = schemaFields(t)
+		}
+		entries := make([]entry, 0, len(n.keys))
+		for i, k := range n.keys {
+			v := n.items[i]
+			if v.kind == nullNode {
+				continue
+			}
+			e := entry{k: k, name: k.value.(string)}
+			vt := t
+			if f, ok := fields[e.name]; ok {
+				vt = f.Type
+				e.order = f.Index[0]
+			} else if t.Kind() == reflect.Map {
+				vt = t.Elem()
+			}
+			e.v = canonicalNode(v, vt, depth+1)
+			entries = append(entries, e)
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			if fields != nil {
+				return entries[i].order < entries[j].order
+			}
+			return entries[i].name < entries[j].name
+		})
+		c := &node{kind: mapNode, trailing: n.trailing}
+		for _, e := range entries {
+			c.keys = append(c.keys, e.k)
+			c.items = append(c.items, e.v)
+		}
+		/* Recipe, tasks and the tables of the recipe are TOML sections */
+		c.table = t.Kind() == reflect.Struct || depth == 1 ||
+			(t.Kind() == reflect.Map && t.Elem().Kind() == reflect.Ptr)
+		return c
+	case listNode:
+		c := &node{kind: listNode}
+		et := t
+		if t.Kind() == reflect.Slice {
+			et = t.Elem()
+		}
+		for _, item := range n.items {
+			if item.kind != nullNode {
+				c.items = append(c.items, canonicalNode(item, et, depth+1))
+			}
+		}
+		return c
+	}
+	return n
+}
+
+/*
+ * JSON
+ */
+
+func encodeJSON(n *node) []byte {
+	var b bytes.Buffer
+	writeJSON(&b, n, 0)
+	b.WriteString("\n")
+	return b.Bytes()
+}
+
+func writeJSON(b *bytes.Buffer, n *node, depth int) {
+	indent := strings.Repeat("  ", depth+1)
+	switch n.kind {
+	case mapNode:
+		if len(n.keys) == 0 && len(n.trailing) == 0 {
+			b.WriteString("{}")
+			return
+		}
+		b.WriteString("{\n")
+		for i, k := range n.keys {
+			writeComments(b, indent+"//", k.comments)
+			b.WriteString(indent)
+			b.WriteString(jsonScalar(k.value))
+			b.WriteString(": ")
+			writeJSON(b, n.items[i], depth+1)
+			if i < len(n.keys)-1 {
+				b.WriteString(",")
+			}
+			b.WriteString("\n")
+		}
+		writeComments(b, indent+"//", n.trailing)
+		b.WriteString(indent[2:])
+		b.WriteString("}")
+	case listNode:
+		if len(n.items) == 0 {
+			b.WriteString("[]")
+			return
+		}
+		b.WriteString("[\n")
+		for i, item := range n.items {
+			b.WriteString(indent)
+			writeJSON(b, item, depth+1)
+			if i < len(n.items)-1 {
+				b.WriteString(",")
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString(indent[2:])
+		b.WriteString("]")
+	case nullNode:
+		b.WriteString("null")
+	default:
+		b.WriteString(jsonScalar(n.value))
+	}
+}
+
+func jsonScalar(v interface{}) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return fmt.Sprintf("%q", fmt.Sprint(v))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func writeComments(b *bytes.Buffer, prefix string, comments []string) {
+	for _, c := range comments {
+		b.WriteString(prefix)
+		if c != "" {
+			b.WriteString(" ")
+			b.WriteString(c)
+		}
+		b.WriteString("\n")
+	}
+}
+
+/*
+ * TOML
+ */
+
+var tomlBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func encodeTOML(n *node) []byte {
+	var b bytes.Buffer
+	writeTOMLTable(&b, n, nil, nil)
+	writeComments(&b, "#", n.trailing)
+	return bytes.TrimLeft(b.Bytes(), "\n")
+}
+
+func writeTOMLTable(b *bytes.Buffer, n *node, key *node, path []string) {
+	sections := make([]int, 0)
+	inline := make([]int, 0)
+	for i, item := range n.items {
+		if item.kind == mapNode && (item.table || !item.bareKeys()) {
+			sections = append(sections, i)
+		} else {
+			inline = append(inline, i)
+		}
+	}
+	if key != nil && (len(inline) > 0 || len(key.comments) > 0 || len(sections) == 0) {
+		b.WriteString("\n")
+		writeComments(b, "#", key.comments)
+		b.WriteString("[")
+		b.WriteString(tomlPath(path))
+		b.WriteString("]\n")
+	}
+	for _, i := range inline {
+		k, item := n.keys[i], n.items[i]
+		writeComments(b, "#", k.comments)
+		writeComments(b, "#", item.nestedComments())
+		b.WriteString(tomlKeyName(k.value.(string)))
+		b.WriteString(" = ")
+		writeTOMLValue(b, item)
+		b.WriteString("\n")
+	}
+	for _, i := range sections {
+		name := n.keys[i].value.(string)
+		writeTOMLTable(b, n.items[i], n.keys[i], append(path[:len(path):len(path)], name))
+	}
+}
+
+/* Quoted keys are not supported in the inline tables */
+func (n *node) bareKeys() bool {
+	for _, k := range n.keys {
+		if !tomlBareKey.MatchString(k.value.(string)) {
+			return false
+		}
+	}
+	return true
+}
+
+/* Comments of the keys of inline tables, which only can be written before them */
+func (n *node) nestedComments() []string {
+	comments := make([]string, 0)
+	for i, k := range n.keys {
+		comments = append(comments, k.comments...)
+		comments = append(comments, n.items[i].nestedComments()...)
+	}
+	if n.kind == listNode {
+		for _, item := range n.items {
+			comments = append(comments, item.nestedComments()...)
+		}
+	}
+	return comments
+}
+
+func writeTOMLValue(b *bytes.Buffer, n *node) {
+	switch n.kind {
+	case mapNode:
+		b.WriteString("{")
+		for i, k := range n.keys {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(tomlKeyName(k.value.(string)))
+			b.WriteString(" = ")
+			writeTOMLValue(b, n.items[i])
+		}
+		b.WriteString("}")
+	case listNode:
+		b.WriteString("[")
+		for i, item := range n.items {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeTOMLValue(b, item)
+		}
+		b.WriteString("]")
+	default:
+		b.WriteString(tomlScalar(n.value))
+	}
+}
+
+func tomlPath(path []string) string {
+	keys := make([]string, len(path))
+	for i, p := range path {
+		keys[i] = tomlKeyName(p)
+	}
+	return strings.Join(keys, ".")
+}
+
+func tomlKeyName(k string) string {
+	if tomlBareKey.MatchString(k) {
+		return k
+	}
+	return tomlBasicString(k)
+}
+
+func tomlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return tomlString(v)
+	case float64:
+		switch {
+		case math.IsInf(v, 1):
+			return "inf"
+		case math.IsInf(v, -1):
+			return "-inf"
+		case math.IsNaN(v):
+			return "nan"
+		}
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+/* Literal strings are preferred when they avoid escaping quotes and backslashes */
+func tomlString(s string) string {
+	plain := utf8.ValidString(s) && !strings.ContainsAny(s, "\r\x7f") && !strings.ContainsAny(s, controlChars)
+	switch {
+	case plain && !strings.Contains(s, "\n") && strings.ContainsAny(s, `"\`) && !strings.Contains(s, "'"):
+		return "'" + s + "'"
+	case plain && strings.Contains(s, "\n") && !strings.Contains(s, "'''") && !strings.HasSuffix(s, "'"):
+		return "'''\n" + s + "'''"
+	}
+	return tomlBasicString(s)
+}
+
+/* Control characters but the tab and the newline */
+var controlChars = func() string {
+	var b strings.Builder
+	for c := rune(0); c < 0x20; c++ {
+		if c != '\t' && c != '\n' {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}()
+
+func tomlBasicString(s string) string {
+	var b strings.Builder
+	b.WriteString(`"`)
+	for _, c := range s {
+		switch c {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, c)
+			} else {
+				b.WriteRune(c)
+			}
+		}
+	}
+	b.WriteString(`"`)
+	return b.String()
+}
+
+/*
+ * YAML
+ */
+
+func encodeYAML(n *node) ([]byte, error) {
+	doc := &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{yamlNode(n)}}
+	doc.FootComment = yamlCommentBlock(n.trailing)
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func yamlNode(n *node) *yaml.Node {
+	switch n.kind {
+	case mapNode:
+		y := &yaml.Node{Kind: yaml.MappingNode}
+		for i, k := range n.keys {
+			yk := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: k.value.(string)}
+			yk.HeadComment = yamlCommentBlock(k.comments)
+			y.Content = append(y.Content, yk, yamlNode(n.items[i]))
+		}
+		return y
+	case listNode:
+		y := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+		for _, item := range n.items {
+			if item.kind != scalarNode {
+				y.Style = 0
+			}
+			y.Content = append(y.Content, yamlNode(item))
+		}
+		return y
+	case nullNode:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+	}
+	switch v := n.value.(type) {
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(v)}
+	case int64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.FormatInt(v, 10)}
+	case float64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: strconv.FormatFloat(v, 'g', -1, 64)}
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: fmt.Sprint(n.value)}
+}
+
+func yamlCommentBlock(comments []string) string {
+	lines := make([]string, len(comments))
+	for i, c := range comments {
+		lines[i] = strings.TrimRight("# "+c, " ")
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,152 @@
+package recipe
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+ * Task inheritance
+ *
+ * A task that extends another one (a task or a template) inherits every
+ * field it does not set. Env maps are merged, so only the keys set by the
+ * task override the inherited ones. AllowFailure is a pointer, so a task can
+ * set it to false even when its parent allows failures.
+ */
+
+func (r *Recipe) resolveExtends() error {
+	for n := range r.Templates {
+		if _, ok := r.Tasks[n]; ok {
+			return fmt.Errorf("In task '%s': There is also a template with the same name", n)
+		}
+	}
+	resolved := make(map[*Task]bool)
+	var resolve func(name string, t *Task, chain []string) error
+	resolve = func(name string, t *Task, chain []string) error {
+		if t.Extends == "" || resolved[t] {
+			return nil
+		}
+		for _, c := range chain {
+			if c == t.Extends {
+				return fmt.Errorf("Inheritance cycle: %s", strings.Join(append(chain, t.Extends), " -> "))
+			}
+		}
+		parent, ok := r.Tasks[t.Extends]
+		if !ok {
+			parent, ok = r.Templates[t.Extends]
+		}
+		if !ok {
+			return fmt.Errorf("In task '%s': Unknown extended task: %s", name, t.Extends)
+		}
+		if err := resolve(t.Extends, parent, append(chain, t.Extends)); err != nil {
+			return err
+		}
+		t.inherit(parent)
+		resolved[t] = true
+		return nil
+	}
+	for _, names := range [][]string{sortedNames(r.Templates), r.taskNames()} {
+		for _, n := range names {
+			t, ok := r.Tasks[n]
+			if !ok {
+				t = r.Templates[n]
+			}
+			if err := resolve(n, t, []string{n}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *Task) inherit(parent *Task) {
+	if t.Deps == nil && parent.Deps != nil {
+		t.Deps = append([]string{}, parent.Deps...)
+	}
+	if t.After == nil && parent.After != nil {
+		t.After = append([]string{}, parent.After...)
+	}
+	if parent.Env != nil {
+		env := make(map[string]string, len(parent.Env)+len(t.Env))
+		for k, v := range parent.Env {
+			env[k] = v
+		}
+		for k, v := range t.Env {
+			env[k] = v
+		}
+		t.Env = env
+	}
+	if t.Interp == nil && parent.Interp != nil {
+		t.Interp = append([]string{}, parent.Interp...)
+	}
+	if t.Cmd == "" {
+		t.Cmd = parent.Cmd
+	}
+	if t.Stdout == "" {
+		t.Stdout = parent.Stdout
+	}
+	if t.Stderr == "" {
+		t.Stderr = parent.Stderr
+	}
+	if t.AllowFailure == nil {
+		t.AllowFailure = parent.AllowFailure
+	}
+	if t.Weight == 0 {
+		t.Weight = parent.Weight
+	}
+	if t.Requires == nil {
+		t.Requires = parent.Requires
+	}
+	if t.Retries == 0 {
+		t.Retries = parent.Retries
+	}
+	if t.RetryDelay == "" {
+		t.RetryDelay = parent.RetryDelay
+	}
+	if t.RetryBackoff == 0 {
+		t.RetryBackoff = parent.RetryBackoff
+	}
+	if t.RetryOnExitCodes == nil {
+		t.RetryOnExitCodes = parent.RetryOnExitCodes
+	}
+	if t.Timeout == "" {
+		t.Timeout = parent.Timeout
+	}
+	if t.RunIf == "" {
+		t.RunIf = parent.RunIf
+	}
+	if t.SkipIf == "" {
+		t.SkipIf = parent.SkipIf
+	}
+	if t.OnSuccess == nil && parent.OnSuccess != nil {
+		t.OnSuccess = append([]string{}, parent.OnSuccess...)
+	}
+	if t.OnFailure == nil && parent.OnFailure != nil {
+		t.OnFailure = append([]string{}, parent.OnFailure...)
+	}
+	if t.Finally == nil && parent.Finally != nil {
+		t.Finally = append([]string{}, parent.Finally...)
+	}
+	if t.Inputs == nil && parent.Inputs != nil {
+		t.Inputs = append([]string{}, parent.Inputs...)
+	}
+	if t.Outputs == nil && parent.Outputs != nil {
+		t.Outputs = append([]string{}, parent.Outputs...)
+	}
+	if t.Matrix == nil {
+		t.Matrix = parent.Matrix
+		if t.Exclude == nil {
+			t.Exclude = parent.Exclude
+		}
+	}
+}
+
+func sortedNames(tasks map[string]*Task) []string {
+	names := make([]string, 0, len(tasks))
+	for n := range tasks {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
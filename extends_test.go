@@ -0,0 +1,121 @@
+package recipe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+/* The tasks inherit the fields of the tasks and templates they extend */
+func TestRecipe_extends(t *testing.T) {
+	txt := `
+main = "t1"
+
+[templates.base]
+interp = ['bash', '-c', 'exec {cmd}']
+env = {A = "a", B = "b"}
+cmd = "echo $NAME $A $B >> %[1]s"
+
+[tasks.t1]
+extends = "t2"
+deps = ["t2"]
+env = {NAME = "t1", B = "c"}
+
+[tasks.t2]
+extends = "base"
+env = {NAME = "t2"}
+`
+	/* Create tmp file */
+	name := "extends_output.txt"
+	defer os.Remove(name)
+
+	/* Create recipe with tmp file */
+	path, err := TmpRecipe("toml", fmt.Sprintf(txt, name))
+	if err != nil {
+		t.Errorf("Writing recipe: %s", err)
+		return
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+
+	/* Run recipe */
+	logger := NewLogger("[Test] ")
+	logger.Level = WarningL
+	r, err := Open(path, logger, logger)
+	if err != nil {
+		t.Errorf("Loading recipe: %s", err)
+		return
+	}
+	err = r.RunMain(testWorkers())
+	if err != nil {
+		t.Errorf("Running recipe: %s", err)
+		return
+	}
+
+	/* Check tmp file */
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Errorf("Reading output: %s", err)
+		return
+	}
+	if string(data) != "t2 a b\nt1 a c\n" {
+		t.Errorf("Invalid data: %s", data)
+	}
+}
+
+func TestRecipe_extendsCycle(t *testing.T) {
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	_, err := Parse(strings.NewReader(`
+main = "t1"
+
+[templates.base]
+extends = "t1"
+
+[tasks.t1]
+extends = "t2"
+
+[tasks.t2]
+extends = "base"
+`), TOML, logger, logger)
+	if err == nil || !strings.Contains(err.Error(), "Inheritance cycle: base -> t1 -> t2 -> base") {
+		t.Errorf("Expected inheritance cycle, not %v", err)
+	}
+}
+
+/* A task can disable the failures allowed by the task it extends */
+func TestRecipe_extendsAllowFailure(t *testing.T) {
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Parse(strings.NewReader(`
+main = "t1"
+interp = ['bash', '-c', '{cmd}']
+
+[templates.flaky]
+allow_failure = true
+cmd = "false"
+
+[tasks.t1]
+extends = "flaky"
+deps = ["t2"]
+allow_failure = false
+
+[tasks.t2]
+extends = "flaky"
+`), TOML, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Tasks["t1"].allowsFailure() || !r.Tasks["t2"].allowsFailure() {
+		t.Fatalf("Wrong inherited allow_failure: %v, %v", r.Tasks["t1"].AllowFailure, r.Tasks["t2"].AllowFailure)
+	}
+	if err := r.RunMain(1); err == nil {
+		t.Error("Expected failure, not success")
+	}
+	if !r.state.IsSuccess("t2") || !r.state.IsFailure("t1") {
+		t.Errorf("Wrong state: %v", r.state.String())
+	}
+}
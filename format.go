@@ -0,0 +1,192 @@
+package recipe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/DisposaBoy/JsonConfigReader"
+	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v3"
+)
+
+type Format string
+
+const (
+	UnknownFormat Format = ""
+	JSON          Format = "json"
+	TOML          Format = "toml"
+	YAML          Format = "yaml"
+)
+
+/* Number of lines at the beginning and at the end of a recipe where a modeline is searched */
+const modelineLines = 5
+
+var (
+	// -*- mode: json; -*-  or  -*- json -*-
+	emacsModeline = regexp.MustCompile(`-\*-\s*(?:.*?\bmode\s*:\s*)?([\w-]+)\s*;?.*?-\*-`)
+	// vim: set ft=toml:  or  vim: filetype=yaml
+	vimModeline = regexp.MustCompile(`\b(?:vim?|ex):.*?\b(?:ft|filetype|syntax)\s*=\s*([\w-]+)`)
+	yamlKey     = regexp.MustCompile(`^("[^"]*"|'[^']*'|[\w.-]+)\s*:(\s|$)`)
+	tomlKey     = regexp.MustCompile(`^("[^"]*"|'[^']*'|[\w.-]+)\s*=`)
+)
+
+// ParseFormat returns the Format with the given name, which may be any of
+// the usual file extensions or editor modes of the format.
+func ParseFormat(name string) Format {
+	switch strings.ToLower(strings.TrimPrefix(name, ".")) {
+	case "json", "javascript", "js":
+		return JSON
+	case "toml":
+		return TOML
+	case "yaml", "yml":
+		return YAML
+	}
+	return UnknownFormat
+}
+
+// FormatFromPath guesses the Format of a recipe from its file extension.
+func FormatFromPath(path string) Format {
+	return ParseFormat(filepath.Ext(path))
+}
+
+// SniffFormat guesses the Format of a recipe from its content. An Emacs or
+// Vim modeline found in its first or last lines takes precedence over the
+// syntax of the document.
+func SniffFormat(data []byte) Format {
+	if f := modelineFormat(data); f != UnknownFormat {
+		return f
+	}
+	return contentFormat(data)
+}
+
+func modelineFormat(data []byte) Format {
+	lines := strings.Split(string(data), "\n")
+	candidates := lines
+	if len(lines) > 2*modelineLines {
+		candidates = append(lines[:modelineLines:modelineLines], lines[len(lines)-modelineLines:]...)
+	}
+	for _, l := range candidates {
+		for _, re := range []*regexp.Regexp{emacsModeline, vimModeline} {
+			if m := re.FindStringSubmatch(l); m != nil {
+				if f := ParseFormat(m[1]); f != UnknownFormat {
+					return f
+				}
+			}
+		}
+	}
+	return UnknownFormat
+}
+
+func contentFormat(data []byte) Format {
+	inComment := false
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		/* Skip the comments of every format */
+		if inComment {
+			if i := strings.Index(l, "*/"); i >= 0 {
+				inComment = false
+				l = strings.TrimSpace(l[i+2:])
+			} else {
+				continue
+			}
+		}
+		if strings.HasPrefix(l, "/*") {
+			inComment = !strings.Contains(l[2:], "*/")
+			continue
+		}
+		if l == "" || strings.HasPrefix(l, "#") || strings.HasPrefix(l, "//") {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(l, "{"):
+			return JSON
+		case strings.HasPrefix(l, "---") || strings.HasPrefix(l, "%YAML") || strings.HasPrefix(l, "- "):
+			return YAML
+		case strings.HasPrefix(l, "["):
+			return TOML
+		case tomlKey.MatchString(l):
+			return TOML
+		case yamlKey.MatchString(l):
+			return YAML
+		}
+		return UnknownFormat
+	}
+	return UnknownFormat
+}
+
+/*
+ * The diagnostics of the validation are returned without an error when the
+ * valid values could still be decoded, so the recipe can be checked too.
+ */
+func decode(data []byte, format Format, r *Recipe) (Diagnostics, error) {
+	n, err := parseNode(data, format)
+	if err != nil {
+		return nil, err
+	}
+	ds := validateNode(n, reflect.TypeOf(r))
+	if len(ds) > 0 {
+		b, err := json.Marshal(n.plain())
+		if err == nil {
+			err = json.Unmarshal(b, r)
+		}
+		if err != nil {
+			return nil, ds
+		}
+		r.setPositions(n)
+		return ds, nil
+	}
+	switch format {
+	case JSON:
+		err = json.NewDecoder(JsonConfigReader.New(bytes.NewReader(data))).Decode(r)
+	case TOML:
+		err = decodeTOML(data, r)
+	case YAML:
+		err = yaml.NewDecoder(bytes.NewReader(data)).Decode(r)
+	default:
+		err = errUnknownFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.setPositions(n)
+	return nil, nil
+}
+
+/*
+ * go-toml has no custom unmarshalers, so a single main task is turned into a
+ * list, and it does not convert integers to floats, so neither are the
+ * float fields of the tasks
+ */
+func decodeTOML(data []byte, v interface{}) error {
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return err
+	}
+	if name, ok := tree.Get("main").(string); ok {
+		tree.Set("main", []interface{}{name})
+	}
+	for _, section := range []string{"tasks", "templates"} {
+		tasks, ok := tree.Get(section).(*toml.Tree)
+		if !ok {
+			continue
+		}
+		for _, n := range tasks.Keys() {
+			task, ok := tasks.GetPath([]string{n}).(*toml.Tree)
+			if !ok {
+				continue
+			}
+			for _, key := range []string{"weight", "retry_backoff"} {
+				if value, ok := task.Get(key).(int64); ok {
+					task.Set(key, float64(value))
+				}
+			}
+		}
+	}
+	return tree.Unmarshal(v)
+}
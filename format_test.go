@@ -0,0 +1,46 @@
+package recipe
+
+import (
+	"testing"
+)
+
+func TestFormat_ParseFormat(t *testing.T) {
+	_testParseFormat := func(t *testing.T, name string, expected Format) {
+		if obtained := ParseFormat(name); obtained != expected {
+			t.Errorf("Error testing %q: %q", name, obtained)
+		}
+	}
+	_testParseFormat(t, "json", JSON)
+	_testParseFormat(t, ".json", JSON)
+	_testParseFormat(t, "TOML", TOML)
+	_testParseFormat(t, "yml", YAML)
+	_testParseFormat(t, ".yaml", YAML)
+	_testParseFormat(t, "ini", UnknownFormat)
+	_testParseFormat(t, "", UnknownFormat)
+}
+
+func TestFormat_SniffFormat(t *testing.T) {
+	_testSniffFormat := func(t *testing.T, txt string, expected Format) {
+		if obtained := SniffFormat([]byte(txt)); obtained != expected {
+			t.Errorf("Error testing <<<%s>>>: %q", txt, obtained)
+		}
+	}
+	/* Content */
+	_testSniffFormat(t, `{"main": "t1"}`, JSON)
+	_testSniffFormat(t, "/* Comment\n */\n\n{\"main\": \"t1\"}", JSON)
+	_testSniffFormat(t, "// Comment\n{\"main\": \"t1\"}", JSON)
+	_testSniffFormat(t, "main = \"t1\"", TOML)
+	_testSniffFormat(t, "# Comment\n[tasks.t1]\ncmd = \"echo\"", TOML)
+	_testSniffFormat(t, "main: t1", YAML)
+	_testSniffFormat(t, "# Comment\n---\nmain: t1", YAML)
+	_testSniffFormat(t, "", UnknownFormat)
+	_testSniffFormat(t, "Hi world", UnknownFormat)
+
+	/* Modelines */
+	_testSniffFormat(t, "# -*- mode: yaml -*-\nmain = \"t1\"", YAML)
+	_testSniffFormat(t, "// -*- coding: utf-8; mode: json; -*-\n", JSON)
+	_testSniffFormat(t, "# -*- toml -*-\n", TOML)
+	_testSniffFormat(t, "# -*- coding: utf-8 -*-\nmain: t1", YAML)
+	_testSniffFormat(t, "main = \"t1\"\n# vim: set ft=yaml:", YAML)
+	_testSniffFormat(t, "main: t1\n# vi: filetype=toml", TOML)
+}
@@ -0,0 +1,196 @@
+package recipe
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+ * Dependency graph analysis
+ */
+
+func (r *Recipe) taskNames() []string {
+	return sortedNames(r.Tasks)
+}
+
+// cycles returns the cycles of every group of tasks that depend on each
+// other in the dependency graph, where the tasks in after count as deps, as
+// they could wait for each other. The groups are the strongly connected
+// components of the graph, found in linear time with Tarjan's algorithm.
+// Each group is walked depth first from its smallest task name, following
+// the deps in the same direction as they are declared, and every dep that
+// leads back to a task being walked closes a cycle. That cycle starts and
+// ends with the dep, and is the shortest one through that dep and the task
+// that closes it.
+func (r *Recipe) cycles() [][]string {
+	cycles := make([][]string, 0)
+	for _, component := range r.components() {
+		inComponent := make(map[string]bool, len(component))
+		for _, n := range component {
+			inComponent[n] = true
+		}
+		visited := make(map[string]bool, len(component))
+		walking := make(map[string]bool, len(component))
+		var visit func(n string)
+		visit = func(n string) {
+			visited[n] = true
+			walking[n] = true
+			for _, d := range r.Tasks[n].predecessors() {
+				switch {
+				case walking[d]:
+					cycles = append(cycles, append(r.shortestPath(d, n, inComponent), d))
+				case !visited[d] && inComponent[d]:
+					visit(d)
+				}
+			}
+			walking[n] = false
+		}
+		visit(component[0])
+	}
+	return cycles
+}
+
+/* The strongly connected components, each one sorted and by its first name */
+func (r *Recipe) components() [][]string {
+	index := make(map[string]int)
+	lowLink := make(map[string]int)
+	onStack := make(map[string]bool)
+	stack := []string{}
+	components := [][]string{}
+	var visit func(n string)
+	visit = func(n string) {
+		index[n] = len(index)
+		lowLink[n] = index[n]
+		stack = append(stack, n)
+		onStack[n] = true
+		for _, d := range r.Tasks[n].predecessors() {
+			if _, ok := r.Tasks[d]; !ok {
+				continue
+			}
+			if _, visited := index[d]; !visited {
+				visit(d)
+				if lowLink[d] < lowLink[n] {
+					lowLink[n] = lowLink[d]
+				}
+			} else if onStack[d] && index[d] < lowLink[n] {
+				lowLink[n] = index[d]
+			}
+		}
+		if lowLink[n] != index[n] {
+			return
+		}
+		component := []string{}
+		for {
+			last := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[last] = false
+			component = append(component, last)
+			if last == n {
+				break
+			}
+		}
+		sort.Strings(component)
+		components = append(components, component)
+	}
+	for _, n := range r.taskNames() {
+		if _, visited := index[n]; !visited {
+			visit(n)
+		}
+	}
+	sort.Slice(components, func(i, j int) bool {
+		return components[i][0] < components[j][0]
+	})
+	return components
+}
+
+/* The shortest path between two tasks of the same component, following the deps */
+func (r *Recipe) shortestPath(from, to string, inComponent map[string]bool) []string {
+	previous := map[string]string{from: ""}
+	queue := []string{from}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if n == to {
+			path := []string{}
+			for ; n != from; n = previous[n] {
+				path = append(path, n)
+			}
+			path = append(path, from)
+			for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+				path[i], path[j] = path[j], path[i]
+			}
+			return path
+		}
+		for _, d := range r.Tasks[n].predecessors() {
+			if _, seen := previous[d]; seen || !inComponent[d] {
+				continue
+			}
+			previous[d] = n
+			queue = append(queue, d)
+		}
+	}
+	return nil
+}
+
+/* The given tasks and all their dependencies, sorted by name */
+func (r *Recipe) dependencies(names []string) []string {
+	seen := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		if t, ok := r.Tasks[name]; ok {
+			for _, d := range t.Deps {
+				visit(d)
+			}
+		}
+	}
+	for _, n := range names {
+		visit(n)
+	}
+	deps := make([]string, 0, len(seen))
+	for n := range seen {
+		deps = append(deps, n)
+	}
+	sort.Strings(deps)
+	return deps
+}
+
+/* The tasks that must end before this one: its deps and the ones in after */
+func (t *Task) predecessors() []string {
+	return uniqueNames(append(append([]string{}, t.Deps...), t.After...))
+}
+
+func uniqueNames(names []string) []string {
+	seen := make(map[string]bool, len(names))
+	unique := make([]string, 0, len(names))
+	for _, n := range names {
+		if !seen[n] {
+			seen[n] = true
+			unique = append(unique, n)
+		}
+	}
+	return unique
+}
+
+/*
+ * Cycle Error
+ */
+
+type CycleError struct {
+	Cycles [][]string
+}
+
+func (e *CycleError) Error() string {
+	paths := make([]string, len(e.Cycles))
+	for i, c := range e.Cycles {
+		paths[i] = strings.Join(c, " -> ")
+	}
+	if len(paths) == 1 {
+		return fmt.Sprintf("Dependency cycle: %s", paths[0])
+	}
+	return fmt.Sprintf("%d dependency cycles: %s", len(paths), strings.Join(paths, ", "))
+}
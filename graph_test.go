@@ -0,0 +1,190 @@
+package recipe
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* Every group of tasks that depend on each other is reported as a cycle */
+func TestRecipe_cycles(t *testing.T) {
+	txt := `
+main = "t1"
+
+[tasks.t1]
+deps = ["t2"]
+
+[tasks.t2]
+deps = ["t3", "t4"]
+
+[tasks.t3]
+deps = ["t1"]
+
+[tasks.t4]
+deps = ["t4"]
+`
+	expected := []string{"t1 -> t2 -> t3 -> t1", "t4 -> t4"}
+	path, err := TmpRecipe("toml", txt)
+	if err != nil {
+		t.Errorf("Writing recipe: %s", err)
+		return
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	_, err = Open(path, logger, logger)
+	var cycleErr *CycleError
+	if !errors.As(err, &cycleErr) {
+		t.Errorf("Expected a CycleError, not %v", err)
+		return
+	}
+	if len(cycleErr.Cycles) != len(expected) {
+		t.Errorf("Wrong cycles: %s", cycleErr)
+		return
+	}
+	for i, c := range cycleErr.Cycles {
+		if strings.Join(c, " -> ") != expected[i] {
+			t.Errorf("Wrong cycle: %s", strings.Join(c, " -> "))
+		}
+	}
+}
+
+/* Every cycle of a group is reported, even when they share a task */
+func TestRecipe_cyclesSharedTask(t *testing.T) {
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := NewRecipe(WithLogger(logger), WithMain("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, deps := range map[string][]string{"a": {"b", "c"}, "b": {"a"}, "c": {"a"}} {
+		if err := r.AddTask(n, &Task{Deps: deps, Cmd: "true"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = r.Check()
+	var cycleErr *CycleError
+	if !errors.As(err, &cycleErr) {
+		t.Fatalf("Expected a CycleError, not %v", err)
+	}
+	if expected := "2 dependency cycles: a -> b -> a, a -> c -> a"; cycleErr.Error() != expected {
+		t.Errorf("Wrong cycles: %s", cycleErr)
+	}
+}
+
+/* The tasks in after only order the run */
+func TestRecipe_after(t *testing.T) {
+	txt := `
+interp = ['bash', '-c', '{cmd}']
+
+[tasks.generate]
+cmd = "sleep 0.2; echo generate >> %[1]s"
+
+[tasks.lint]
+after = ["generate"]
+cmd = "echo lint >> %[1]s"
+`
+	name := "after_output.txt"
+	defer os.Remove(name)
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Parse(strings.NewReader(fmt.Sprintf(txt, name)), TOML, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := func() string {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(name)
+		return strings.Join(strings.Fields(string(data)), " ")
+	}
+
+	/* When both are run, lint waits for generate */
+	if err := r.RunTasks([]string{"lint", "generate"}, testWorkers()); err != nil {
+		t.Fatal(err)
+	}
+	if lines := output(); lines != "generate lint" {
+		t.Errorf("Invalid data: %s", lines)
+	}
+	/* But lint alone does not run generate */
+	if err := r.RunTask("lint", testWorkers()); err != nil {
+		t.Fatal(err)
+	}
+	if lines := output(); lines != "lint" {
+		t.Errorf("Invalid data: %s", lines)
+	}
+}
+
+func TestRecipe_afterCycle(t *testing.T) {
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	_, err := Parse(strings.NewReader(`
+[tasks.t1]
+deps = ["t2"]
+cmd = "true"
+
+[tasks.t2]
+after = ["t1"]
+cmd = "true"
+`), TOML, logger, logger)
+	if err == nil || err.Error() != "2:1: Dependency cycle: t1 -> t2 -> t1" {
+		t.Errorf("Expected a cycle, not %v", err)
+	}
+}
+
+/* Each task depends on every task of the next layer, with ascending names */
+func layeredRecipe(t *testing.T, layers, width int) *Recipe {
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := NewRecipe(WithLogger(logger), WithMain("l00t0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for l := 0; l < layers; l++ {
+		for w := 0; w < width; w++ {
+			deps := []string{}
+			if l+1 < layers {
+				for d := 0; d < width; d++ {
+					deps = append(deps, fmt.Sprintf("l%02dt%d", l+1, d))
+				}
+			}
+			if err := r.AddTask(fmt.Sprintf("l%02dt%d", l, w), &Task{Deps: deps, Cmd: "true"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return r
+}
+
+func TestRecipe_cyclesLayered(t *testing.T) {
+	r := layeredRecipe(t, 40, 3)
+	start := time.Now()
+	if err := r.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Checking an acyclic recipe took %s", elapsed)
+	}
+
+	/* Closing the last layer with the first one makes a single cycle */
+	r = layeredRecipe(t, 40, 3)
+	r.Tasks["l39t2"].Deps = []string{"l00t1"}
+	err := r.Check()
+	var cycleErr *CycleError
+	if !errors.As(err, &cycleErr) || len(cycleErr.Cycles) != 1 {
+		t.Fatalf("Expected one cycle, not %v", err)
+	}
+	cycle := cycleErr.Cycles[0]
+	if len(cycle) != 41 || cycle[0] != "l00t1" || cycle[1] != "l01t0" || cycle[39] != "l39t2" || cycle[40] != "l00t1" {
+		t.Errorf("Wrong cycle: %s", err)
+	}
+}
@@ -0,0 +1,113 @@
+package recipe
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+/*
+ * Hooks
+ *
+ * The on_success, on_failure and finally of the tasks and the recipe list
+ * tasks that are run after the main tasks. The hooks of a task depend on
+ * its final state: on_success when it succeeds, on_failure when it fails or
+ * times out, and finally whenever it was started. The hooks of the recipe
+ * depend on the whole run, and finally is always run, even if the run was
+ * interrupted or reached its deadline.
+ *
+ * Every hook is run, even if other ones fail, and their failures are
+ * reported apart from the ones of the run. The hooks of the hooks are not
+ * run. Unlike the rest of the tasks, the hooks are not resumed: they are run
+ * again even if they succeeded before, and when only the hooks fail the
+ * state file is removed as after a successful run.
+ */
+
+// HooksError is returned when any hook fails. Err is the error of the run,
+// if it also failed.
+type HooksError struct {
+	Err   error
+	Hooks error
+}
+
+func (e *HooksError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("Hooks: %s", e.Hooks.Error())
+	}
+	return fmt.Sprintf("%s; Hooks: %s", e.Err.Error(), e.Hooks.Error())
+}
+
+func (e *HooksError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Hooks}
+	}
+	return []error{e.Err, e.Hooks}
+}
+
+func (r *Recipe) checkHooks(c *checker) {
+	unknown := func(names []string) []string {
+		refs := []string{}
+		for _, n := range names {
+			if _, ok := r.Tasks[n]; !ok {
+				refs = append(refs, n)
+			}
+		}
+		return refs
+	}
+	fields := []string{"on_success", "on_failure", "finally"}
+	for _, n := range r.taskNames() {
+		t := r.Tasks[n]
+		for i, names := range [][]string{t.OnSuccess, t.OnFailure, t.Finally} {
+			for _, ref := range unknown(names) {
+				c.task(n, fmt.Errorf("In task '%s': Unknown referenced task in %s: %s", n, fields[i], ref))
+			}
+		}
+	}
+	for i, names := range [][]string{r.OnSuccess, r.OnFailure, r.Finally} {
+		for _, ref := range unknown(names) {
+			c.key(fields[i], fmt.Errorf("Unknown referenced task in %s: %s", fields[i], ref))
+		}
+	}
+}
+
+/* The hooks to run after running the targets */
+func (r *Recipe) hooks(targets Targets, failed bool) Targets {
+	hooks := Targets{}
+	for _, n := range r.dependencies(targets) {
+		t := r.Tasks[n]
+		switch {
+		case r.state.IsSuccess(n):
+			hooks = append(hooks, t.OnSuccess...)
+		case r.state.IsFailure(n), r.state.IsTimedOut(n):
+			hooks = append(hooks, t.OnFailure...)
+		}
+		if r.state.IsSuccess(n) || r.state.IsFailure(n) || r.state.IsTimedOut(n) || r.state.IsCancelled(n) {
+			hooks = append(hooks, t.Finally...)
+		}
+	}
+	if failed {
+		hooks = append(hooks, r.OnFailure...)
+	} else {
+		hooks = append(hooks, r.OnSuccess...)
+	}
+	hooks = append(hooks, r.Finally...)
+	return Targets(uniqueNames(hooks))
+}
+
+/* Runs every hook, and their dependencies, without stopping on failures */
+func (r *Recipe) runHooks(ctx context.Context, hooks Targets, numWorkers uint) error {
+	r.logger.Info("Hooks: %s", hooks)
+	keepGoing := r.keepGoing
+	r.keepGoing = true
+	defer func() { r.keepGoing = keepGoing }()
+	r.retryAt = make(map[string]time.Time)
+	/* The hooks are run every time, even if they succeeded in a previous run */
+	for _, n := range hooks {
+		r.state.SetDisabled(n)
+	}
+	err := r.schedule(ctx, hooks, numWorkers)
+	if err != nil {
+		r.logger.Error("Hooks failed: %s", err.Error())
+	}
+	return err
+}
@@ -0,0 +1,221 @@
+package recipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* The hooks run after the main tasks, depending on how they ended */
+func TestRecipe_hooks(t *testing.T) {
+	txt := `
+main = "t"
+interp = ['bash', '-c', 'echo {task} >> %[1]s; {cmd}']
+on_success = ["celebrate"]
+on_failure = ["notify"]
+finally = ["cleanup"]
+
+[tasks.t]
+deps = ["a", "b"]
+cmd = "true"
+
+[tasks.a]
+on_success = ["a_ok"]
+finally = ["a_done"]
+cmd = "true"
+
+[tasks.b]
+on_success = ["b_ok"]
+on_failure = ["b_failed"]
+cmd = "false"
+
+[tasks.a_ok]
+cmd = "true"
+
+[tasks.a_done]
+cmd = "true"
+
+[tasks.b_ok]
+cmd = "true"
+
+[tasks.b_failed]
+cmd = "true"
+
+[tasks.celebrate]
+cmd = "true"
+
+[tasks.notify]
+cmd = "true"
+
+[tasks.cleanup]
+cmd = "true"
+`
+	name := "hooks_output.txt"
+	defer os.Remove(name)
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Parse(strings.NewReader(fmt.Sprintf(txt, name)), TOML, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetKeepGoing(true)
+	/* The hooks succeed, so only the failure of the run is returned */
+	err = r.RunMain(testWorkers())
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Task() != "b" {
+		t.Fatalf("Expected b failure, not %v", err)
+	}
+	if lines := sortedLines(t, name); lines != "a a_done a_ok b b_failed cleanup notify" {
+		t.Errorf("Invalid data: %s", lines)
+	}
+}
+
+func TestRecipe_hooksInterrupted(t *testing.T) {
+	name := "hooks_output.txt"
+	defer os.Remove(name)
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Parse(strings.NewReader(fmt.Sprintf(`
+main = "t1"
+interp = ['bash', '-c', '{cmd}']
+on_failure = ["broken"]
+finally = ["cleanup"]
+
+[tasks.t1]
+cmd = "sleep 10"
+
+[tasks.broken]
+cmd = "exit 3"
+
+[tasks.cleanup]
+cmd = "echo cleanup >> %s"
+`, name)), TOML, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	err = r.RunMainContext(ctx, testWorkers())
+
+	/* The failures of the hooks are reported apart */
+	var hooksErr *HooksError
+	if !errors.As(err, &hooksErr) {
+		t.Fatalf("Expected a hooks error, not %v", err)
+	}
+	if !errors.Is(hooksErr.Err, context.DeadlineExceeded) {
+		t.Errorf("Expected an interruption, not %v", hooksErr.Err)
+	}
+	var errs Errors
+	if !errors.As(hooksErr.Hooks, &errs) || len(errs) != 1 || errs[0].Task() != "broken" {
+		t.Errorf("Expected broken failure, not %v", hooksErr.Hooks)
+	}
+	if lines := sortedLines(t, name); lines != "cleanup" {
+		t.Errorf("Invalid data: %s", lines)
+	}
+	if !(r.state.IsCancelled("t1") && r.state.IsFailure("broken") && r.state.IsSuccess("cleanup")) {
+		t.Errorf("Wrong state: %v", r.state.String())
+	}
+}
+
+/* The hooks are run again when a failed run is resumed */
+func TestRecipe_hooksResumed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, err := TmpRecipe("toml", fmt.Sprintf(`
+main = "t1"
+interp = ['bash', '-c', '{cmd}']
+finally = ["teardown"]
+
+[tasks.t1]
+cmd = "test -f %[1]s/flag"
+
+[tasks.teardown]
+cmd = "echo teardown >> %[1]s/log"
+`, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+
+	logger := NewLogger("[Test] ")
+	logger.Level = FatalL
+	run := func() error {
+		r, err := Open(path, logger, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.RunMain(1)
+	}
+	if err := run(); err == nil {
+		t.Fatal("Expected failure, not success")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "flag"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "log"))
+	if lines := strings.Fields(string(data)); len(lines) != 2 {
+		t.Errorf("Expected two teardowns, not %q", data)
+	}
+}
+
+/* When only the hooks fail the run is finished, and the state file removed */
+func TestRecipe_hooksFailAfterSuccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, err := TmpRecipe("toml", fmt.Sprintf(`
+main = "t1"
+interp = ['bash', '-c', '{cmd}']
+on_success = ["notify"]
+
+[tasks.t1]
+cmd = "echo t1 >> %[1]s/log"
+
+[tasks.notify]
+cmd = "false"
+`, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+
+	logger := NewLogger("[Test] ")
+	logger.Level = FatalL
+	r, err := Open(path, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err = r.RunMain(1)
+		var hooksErr *HooksError
+		if !errors.As(err, &hooksErr) || hooksErr.Err != nil {
+			t.Fatalf("Expected only a hooks failure, not %v", err)
+		}
+		if _, err := os.Stat(path + ".state"); !os.IsNotExist(err) {
+			t.Errorf("The state file was kept: %v", err)
+		}
+	}
+	/* The finished run is not resumed */
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "log"))
+	if string(data) != "t1\nt1\n" {
+		t.Errorf("Invalid data: %q", data)
+	}
+}
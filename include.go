@@ -0,0 +1,164 @@
+package recipe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+ * Includes and imports
+ *
+ * Included recipes add their tasks with the same names, while imported ones
+ * add them under a namespace, so "build" imported as "backend" becomes
+ * "backend:build". The env and interp of those recipes are moved into their
+ * tasks to keep running them as they would run alone.
+ */
+
+const namespaceSeparator = ":"
+
+func (r *Recipe) resolveIncludes(dir string, stack []string) error {
+	if r.included {
+		return nil
+	}
+	r.included = true
+	if r.Tasks == nil {
+		r.Tasks = make(map[string]*Task)
+	}
+	for _, path := range r.Include {
+		other, err := openInclude(dir, path, stack)
+		if err != nil {
+			return err
+		}
+		if err := r.mergeTasks(other, "", path); err != nil {
+			return err
+		}
+	}
+	namespaces := make([]string, 0, len(r.Import))
+	for ns := range r.Import {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		if ns == "" || strings.Contains(ns, namespaceSeparator) {
+			return fmt.Errorf("Invalid import namespace: '%s'", ns)
+		}
+		path := r.Import[ns]
+		other, err := openInclude(dir, path, stack)
+		if err != nil {
+			return err
+		}
+		if err := r.mergeTasks(other, ns+namespaceSeparator, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func openInclude(dir, path string, stack []string) (*Recipe, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range stack {
+		if p == abs {
+			return nil, fmt.Errorf("Recursive include: %s", strings.Join(append(stack, abs), " -> "))
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format := FormatFromPath(path)
+	if format == UnknownFormat {
+		format = SniffFormat(data)
+	}
+	var other Recipe
+	ds, err := decode(data, format, &other)
+	if err == nil && len(ds) > 0 {
+		err = ds
+	}
+	if err != nil {
+		return nil, withFile(path, err)
+	}
+	other.setPositionsFile(path)
+	other.dir = filepath.Dir(path)
+	if err := other.resolve(other.dir, append(stack, abs)); err != nil {
+		return nil, withFile(path, err)
+	}
+	return &other, nil
+}
+
+func (r *Recipe) mergeTasks(other *Recipe, prefix, path string) error {
+	/* Their resources are the defaults of the ones in this recipe, as all the tasks share the same pools */
+	for k, v := range other.Resources {
+		if _, ok := r.Resources[k]; !ok {
+			if r.Resources == nil {
+				r.Resources = make(map[string]int)
+			}
+			r.Resources[k] = v
+		}
+	}
+	for _, n := range other.taskNames() {
+		t := other.Tasks[n]
+		name := prefix + n
+		if _, ok := r.Tasks[name]; ok {
+			return fmt.Errorf("In task '%s': Conflicts with the task included from %s", name, path)
+		}
+		for _, names := range [][]string{t.Deps, t.After, t.OnSuccess, t.OnFailure, t.Finally} {
+			for i, d := range names {
+				names[i] = prefix + d
+			}
+		}
+		/* Its fields were already inherited in its own recipe */
+		t.Extends = ""
+		r.mergeVars(other, t, prefix != "")
+		env := make(map[string]string, len(other.Env)+len(t.Env))
+		for k, v := range other.Env {
+			env[k] = v
+		}
+		for k, v := range t.Env {
+			env[k] = v
+		}
+		t.Env = env
+		if t.dir == "" {
+			t.dir = other.dir
+		}
+		if t.Interp == nil {
+			t.Interp = other.Interp
+			if t.Interp == nil {
+				/* An empty interp means the default one */
+				t.Interp = []string{}
+			}
+		}
+		r.Tasks[name] = t
+	}
+	return nil
+}
+
+/*
+ * The tasks keep the variables of their own recipe. The ones of an included
+ * recipe are the defaults of the ones in this recipe, but an imported
+ * recipe keeps using its own ones, like its tasks do with its env.
+ */
+func (r *Recipe) mergeVars(other *Recipe, t *Task, imported bool) {
+	if t.vars == nil {
+		t.vars = other.Vars
+	}
+	t.imported = t.imported || imported
+	vars := make(map[string]string, len(t.vars)+len(r.Vars))
+	for k, v := range t.vars {
+		vars[k] = v
+	}
+	if !t.imported {
+		for k, v := range r.Vars {
+			vars[k] = v
+		}
+	}
+	t.vars = vars
+}
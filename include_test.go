@@ -0,0 +1,238 @@
+package recipe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecipe_import(t *testing.T) {
+	/* Create tmp file */
+	name := "import_output.txt"
+	defer os.Remove(name)
+
+	/* Create recipes with tmp file */
+	yamlPath, err := TmpRecipe("yaml", fmt.Sprintf(`
+main: t1
+interp: [bash, -c, "exec {cmd}"]
+env:
+  WHO: yaml
+tasks:
+  t1:
+    deps: [t2]
+    cmd: echo $WHO t1 >> %[1]s
+  t2:
+    cmd: echo $WHO t2 >> %[1]s
+`, name))
+	if err != nil {
+		t.Errorf("Writing recipe: %s", err)
+		return
+	}
+	defer os.Remove(yamlPath)
+	jsonPath, err := TmpRecipe("json", fmt.Sprintf(`
+{
+	"main": "t3",
+	"tasks": {
+		"t3": {
+			"env": {"WHO": "json"},
+			"cmd": "echo $WHO t3 >> %[1]s",
+		}
+	}
+}
+
+`, name))
+	if err != nil {
+		t.Errorf("Writing recipe: %s", err)
+		return
+	}
+	defer os.Remove(jsonPath)
+	path, err := TmpRecipe("toml", fmt.Sprintf(`
+main = "all"
+include = [%[2]q]
+[import]
+yaml = %[3]q
+[tasks.all]
+deps = ["yaml:t1", "t3"]
+cmd = "echo all >> %[1]s"
+`, name, jsonPath, yamlPath))
+	if err != nil {
+		t.Errorf("Writing recipe: %s", err)
+		return
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+	/* Run recipe */
+	logger := NewLogger("[Test] ")
+	logger.Level = WarningL
+	r, err := Open(path, logger, logger)
+	if err != nil {
+		t.Errorf("Loading recipe: %s", err)
+		return
+	}
+	if deps := r.Tasks["yaml:t1"].Deps; len(deps) != 1 || deps[0] != "yaml:t2" {
+		t.Errorf("Wrong deps: %v", deps)
+		return
+	}
+	err = r.RunMain(testWorkers())
+	if err != nil {
+		t.Errorf("Running recipe: %s", err)
+		return
+	}
+	/* Check tmp file */
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Errorf("Reading output: %s", err)
+		return
+	}
+	lines := strings.Split(string(data), "\n")
+	if !(len(lines) == 5 && lines[3] == "all" && lines[4] == "") {
+		t.Errorf("Invalid data: %s", data)
+	}
+	for _, l := range []string{"yaml t2", "yaml t1", "json t3"} {
+		if !strings.Contains(string(data), l) {
+			t.Errorf("Missing %q in data: %s", l, data)
+		}
+	}
+}
+
+func TestRecipe_importConflict(t *testing.T) {
+	other, err := TmpRecipe("toml", `
+[tasks.t1]
+cmd = "echo t1"
+`)
+	if err != nil {
+		t.Errorf("Writing recipe: %s", err)
+		return
+	}
+	defer os.Remove(other)
+
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	_, err = Parse(strings.NewReader(fmt.Sprintf(`
+main = "t1"
+include = [%q]
+
+[tasks.t1]
+cmd = "echo t1"
+`, other)), TOML, logger, logger)
+	if err == nil || !strings.Contains(err.Error(), "Conflicts") {
+		t.Errorf("Expected conflict, not %v", err)
+	}
+}
+
+func TestRecipe_importRecursive(t *testing.T) {
+	path, err := TmpRecipe("toml", "")
+	if err != nil {
+		t.Errorf("Writing recipe: %s", err)
+		return
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+	err = ioutil.WriteFile(path, []byte(fmt.Sprintf(`
+main = "t1"
+
+[import]
+self = %q
+
+[tasks.t1]
+cmd = "echo t1"
+`, path)), 0600)
+	if err != nil {
+		t.Errorf("Writing recipe: %s", err)
+		return
+	}
+
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	_, err = Open(path, logger, logger)
+	if err == nil || !strings.Contains(err.Error(), "Recursive include") {
+		t.Errorf("Expected recursive include, not %v", err)
+	}
+}
+
+/* The imported tasks use the variables of their own recipe */
+func TestRecipe_importVars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "output")
+	files := map[string]string{
+		"recipe.toml": `
+main = "all"
+include = ["common.toml"]
+
+[vars]
+out = "` + output + `"
+who = "root"
+
+[import]
+backend = "backend.toml"
+frontend = "frontend.toml"
+
+[tasks.all]
+deps = ["backend:build", "frontend:build", "common"]
+cmd = "echo {who} >> {out}"
+`,
+		"backend.toml": `
+[vars]
+v = "backvar"
+
+[tasks.build]
+cmd = "echo {v} >> ` + output + `"
+`,
+		"frontend.toml": `
+[vars]
+v = "frontvar"
+
+[tasks.build]
+cmd = "echo {v} >> ` + output + `"
+`,
+		"common.toml": `
+[vars]
+who = "common"
+what = "default"
+
+[tasks.common]
+cmd = "echo {who}-{what} >> {out}"
+`,
+	}
+	for name, txt := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(txt), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Open(filepath.Join(dir, "recipe.toml"), logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filepath.Join(dir, "recipe.toml.state"))
+	if err := r.RunMain(1); err != nil {
+		t.Fatal(err)
+	}
+	/* The included tasks use the variables of this recipe instead of their defaults */
+	if lines := sortedLines(t, output); lines != "backvar frontvar root root-default" {
+		t.Errorf("Invalid data: %s", lines)
+	}
+
+	/* But the overridden variables are overridden in the imported recipes too */
+	os.Remove(output)
+	r, err = Open(filepath.Join(dir, "recipe.toml"), logger, logger, WithVar("v", "cli"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RunMain(1); err != nil {
+		t.Fatal(err)
+	}
+	if lines := sortedLines(t, output); lines != "cli cli root root-default" {
+		t.Errorf("Invalid overridden data: %s", lines)
+	}
+}
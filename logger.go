@@ -53,6 +53,6 @@ func (l *Logger) Error(format string, v ...interface{}) {
 }
 
 func (l *Logger) Fatal(v ...interface{}) {
-	l.l.Output(2, fmt.Sprintf(color.MagentaString("(F): ")+fmt.Sprint(v...)))
+	l.l.Output(2, color.MagentaString("(F): ")+fmt.Sprint(v...))
 	os.Exit(1)
 }
@@ -0,0 +1,129 @@
+package recipe
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+ * Matrix tasks
+ *
+ * A task with a matrix is expanded into one task per combination of the
+ * matrix values, named like build[GOARCH=amd64,GOOS=linux], with those
+ * values added to its env. The original task is replaced by one without
+ * cmd that depends on every expansion, so it still can be used as a dep.
+ */
+
+func (r *Recipe) expandMatrices() error {
+	for _, n := range r.taskNames() {
+		t := r.Tasks[n]
+		if len(t.Matrix) == 0 {
+			continue
+		}
+		combinations, err := t.matrixCombinations()
+		if err != nil {
+			return fmt.Errorf("In task '%s': %s", n, err.Error())
+		}
+		deps := make([]string, 0, len(combinations))
+		for _, c := range combinations {
+			name := matrixTaskName(n, c)
+			if _, ok := r.Tasks[name]; ok {
+				return fmt.Errorf("In task '%s': Conflicts with the expansion of the matrix of %s", name, n)
+			}
+			expanded := t.clone()
+			expanded.Extends = ""
+			expanded.Matrix = nil
+			expanded.Exclude = nil
+			if expanded.Env == nil {
+				expanded.Env = make(map[string]string, len(c))
+			}
+			for k, v := range c {
+				expanded.Env[k] = v
+			}
+			r.Tasks[name] = expanded
+			deps = append(deps, name)
+		}
+		r.Tasks[n] = &Task{
+			Deps:         deps,
+			AllowFailure: t.AllowFailure,
+			pos:          t.pos,
+			aggregate:    true,
+		}
+	}
+	return nil
+}
+
+func (t *Task) matrixCombinations() ([]map[string]string, error) {
+	keys := make([]string, 0, len(t.Matrix))
+	for k, values := range t.Matrix {
+		if len(values) == 0 {
+			return nil, fmt.Errorf("No values in the matrix for %s", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, e := range t.Exclude {
+		for k := range e {
+			if _, ok := t.Matrix[k]; !ok {
+				return nil, fmt.Errorf("Unknown matrix key in exclude: %s", k)
+			}
+		}
+	}
+
+	combinations := []map[string]string{{}}
+	for _, k := range keys {
+		next := make([]map[string]string, 0, len(combinations)*len(t.Matrix[k]))
+		for _, c := range combinations {
+			for _, v := range t.Matrix[k] {
+				nc := make(map[string]string, len(c)+1)
+				for ck, cv := range c {
+					nc[ck] = cv
+				}
+				nc[k] = v
+				next = append(next, nc)
+			}
+		}
+		combinations = next
+	}
+
+	included := make([]map[string]string, 0, len(combinations))
+	for _, c := range combinations {
+		if !t.excluded(c) {
+			included = append(included, c)
+		}
+	}
+	if len(included) == 0 {
+		return nil, fmt.Errorf("Every combination of the matrix is excluded")
+	}
+	return included, nil
+}
+
+func (t *Task) excluded(combination map[string]string) bool {
+	for _, e := range t.Exclude {
+		match := true
+		for k, v := range e {
+			if combination[k] != v {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func matrixTaskName(name string, combination map[string]string) string {
+	keys := make([]string, 0, len(combination))
+	for k := range combination {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + combination[k]
+	}
+	return name + "[" + strings.Join(pairs, ",") + "]"
+}
@@ -0,0 +1,91 @@
+package recipe
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+/* A matrix task is expanded into one task per combination */
+func TestRecipe_matrix(t *testing.T) {
+	txt := `
+main = "t1"
+interp = ['bash', '-c', 'exec {cmd}']
+
+[tasks.t1]
+deps = ["t2"]
+cmd = "echo t1 >> %[1]s"
+
+[tasks.t2]
+cmd = "echo $OS $ARCH >> %[1]s"
+matrix = {OS = ["linux", "darwin", "windows"], ARCH = ["amd64", "arm64"]}
+exclude = [{OS = "windows", ARCH = "arm64"}]
+`
+	/* Create tmp file */
+	name := "matrix_output.txt"
+	defer os.Remove(name)
+
+	/* Create recipe with tmp file */
+	path, err := TmpRecipe("toml", fmt.Sprintf(txt, name))
+	if err != nil {
+		t.Errorf("Writing recipe: %s", err)
+		return
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+
+	/* Check expanded tasks */
+	b := bytes.Buffer{}
+	logger := NewLogger("[Test] ")
+	logger.l = log.New(&b, "", 0)
+	logger.Level = WarningL
+	r, err := Open(path, logger, logger)
+	if err != nil {
+		t.Errorf("Loading recipe: %s", err)
+		return
+	}
+	/* The task that replaces the matrix has no cmd on purpose */
+	if strings.Contains(b.String(), "No cmd") {
+		t.Errorf("Unexpected warning: %s", b.String())
+	}
+	expected := []string{
+		"t2[ARCH=amd64,OS=linux]",
+		"t2[ARCH=amd64,OS=darwin]",
+		"t2[ARCH=amd64,OS=windows]",
+		"t2[ARCH=arm64,OS=linux]",
+		"t2[ARCH=arm64,OS=darwin]",
+	}
+	if deps := r.Tasks["t2"].Deps; strings.Join(deps, " ") != strings.Join(expected, " ") {
+		t.Errorf("Wrong expansions: %v", deps)
+		return
+	}
+
+	/* Run recipe */
+	err = r.RunMain(testWorkers())
+	if err != nil {
+		t.Errorf("Running recipe: %s", err)
+		return
+	}
+
+	/* Check tmp file */
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Errorf("Reading output: %s", err)
+		return
+	}
+	lines := strings.Split(string(data), "\n")
+	if !(len(lines) == 7 && lines[5] == "t1" && lines[6] == "") {
+		t.Errorf("Invalid data: %s", data)
+		return
+	}
+	for _, l := range []string{"linux amd64", "darwin amd64", "windows amd64", "linux arm64", "darwin arm64"} {
+		if !strings.Contains(string(data), l+"\n") {
+			t.Errorf("Missing %q in data: %s", l, data)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package recipe
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/*
+ * Execution plan
+ *
+ * A plan tells what a run would do without running anything nor changing
+ * the state: the tasks it would enable, the ones already done in the state,
+ * their command lines, and the waves in which they would be dispatched.
+ * The waves assume that every task succeeds and takes the same time, so
+ * they are an approximation of the real order.
+ */
+
+// Plan is the execution plan of a run.
+type Plan struct {
+	Main    Targets        `json:"main"`
+	Workers uint           `json:"workers"`
+	Tasks   []*PlannedTask `json:"tasks"`
+	Done    []string       `json:"done"`
+	Waves   [][]string     `json:"waves"`
+}
+
+// PlannedTask is a task that would be run, with its resolved command line.
+type PlannedTask struct {
+	Name    string   `json:"name"`
+	Deps    []string `json:"deps,omitempty"`
+	Command []string `json:"command"`
+	Wave    int      `json:"wave"`
+}
+
+// PlanMain returns the plan of RunMain.
+func (r *Recipe) PlanMain(numWorkers uint) (*Plan, error) {
+	return r.plan(r.Main, numWorkers)
+}
+
+// PlanTasks returns the plan of RunTasks.
+func (r *Recipe) PlanTasks(tasks []string, numWorkers uint) (*Plan, error) {
+	return r.plan(Targets(tasks), numWorkers)
+}
+
+func (r *Recipe) plan(targets Targets, numWorkers uint) (*Plan, error) {
+	if err := r.checkRun(targets, numWorkers); err != nil {
+		return nil, err
+	}
+	p := &Plan{
+		Main:    targets,
+		Workers: numWorkers,
+		Tasks:   []*PlannedTask{},
+		Done:    []string{},
+		Waves:   [][]string{},
+	}
+
+	/* The same tasks enableTasks would enable, as a finished run is not resumed */
+	enabled := make(map[string]bool)
+	for _, n := range r.dependencies(targets) {
+		if !r.finished && r.state.IsSuccess(n) {
+			p.Done = append(p.Done, n)
+		} else {
+			enabled[n] = true
+		}
+	}
+
+	waves := r.planWaves(enabled, numWorkers)
+	for i, wave := range waves {
+		p.Waves = append(p.Waves, wave)
+		for _, n := range wave {
+			t := r.Tasks[n]
+			command, err := r.commandLine(n, t)
+			if err != nil {
+				return nil, fmt.Errorf("In task '%s': %s", n, err.Error())
+			}
+			p.Tasks = append(p.Tasks, &PlannedTask{n, t.Deps, command, i + 1})
+		}
+	}
+	return p, nil
+}
+
+/* Simulates the scheduler, dispatching the ready tasks in waves */
+func (r *Recipe) planWaves(enabled map[string]bool, numWorkers uint) [][]string {
+	var priorities map[string]float64
+	if r.order == CriticalPathOrder {
+		priorities = r.criticalPaths(func(n string) bool { return enabled[n] })
+	}
+	pending := make(map[string]bool, len(enabled))
+	for n := range enabled {
+		pending[n] = true
+	}
+	waves := [][]string{}
+	for len(pending) > 0 {
+		ready := []*namedTask{}
+		for n := range pending {
+			if r.plannedReady(n, pending) {
+				ready = append(ready, &namedTask{n, r.Tasks[n]})
+			}
+		}
+		sortByPriority(ready, priorities)
+		available := r.newPools()
+		wave := []string{}
+		for _, nt := range ready {
+			if uint(len(wave)) == numWorkers {
+				break
+			}
+			if !available.fits(nt.t) {
+				continue
+			}
+			available.acquire(nt.t)
+			wave = append(wave, nt.n)
+		}
+		if len(wave) == 0 {
+			break
+		}
+		for _, n := range wave {
+			delete(pending, n)
+		}
+		waves = append(waves, wave)
+	}
+	return waves
+}
+
+func (r *Recipe) plannedReady(n string, pending map[string]bool) bool {
+	for _, d := range r.Tasks[n].predecessors() {
+		if pending[d] {
+			return false
+		}
+	}
+	return true
+}
+
+/* The command line that would run the task, or nil if it has no cmd */
+func (r *Recipe) commandLine(n string, t *Task) ([]string, error) {
+	et, err := r.expandTask(n, t)
+	if err != nil {
+		return nil, err
+	}
+	if et.cmd == "" {
+		return nil, nil
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.composeInterpreterCmd(et.cmd, et), nil
+}
+
+/* Checks that the targets can be run */
+func (r *Recipe) checkRun(targets Targets, numWorkers uint) error {
+	if !r.checked {
+		if err := r.Check(); err != nil {
+			return err
+		}
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("No main task")
+	}
+	if err := r.checkTargets(targets); err != nil {
+		return err
+	}
+	if numWorkers == 0 {
+		return fmt.Errorf("At least one worker is needed")
+	}
+	return nil
+}
+
+// JSON returns the plan as indented JSON.
+func (p *Plan) JSON() []byte {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return append(b, '\n')
+}
+
+func (p *Plan) String() string {
+	b := bytes.Buffer{}
+	fmt.Fprintf(&b, "Main: %s\n", p.Main)
+	fmt.Fprintf(&b, "Workers: %d\n", p.Workers)
+	if len(p.Done) > 0 {
+		fmt.Fprintf(&b, "Already done: %s\n", strings.Join(p.Done, ", "))
+	}
+	for i, wave := range p.Waves {
+		fmt.Fprintf(&b, "Wave %d: %s\n", i+1, strings.Join(wave, ", "))
+	}
+	if len(p.Tasks) > 0 {
+		fmt.Fprintf(&b, "Commands:\n")
+	}
+	for _, t := range p.Tasks {
+		if t.Command == nil {
+			fmt.Fprintf(&b, "  %s: (no cmd)\n", t.Name)
+		} else {
+			fmt.Fprintf(&b, "  %s: %s\n", t.Name, shellJoin(t.Command))
+		}
+	}
+	return b.String()
+}
+
+var shellSafeRegexp = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+/* Joins the arguments quoting them as a POSIX shell would need */
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if shellSafeRegexp.MatchString(a) {
+			quoted[i] = a
+		} else {
+			quoted[i] = "'" + strings.Replace(a, "'", `'\''`, -1) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,93 @@
+package recipe
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRecipe_plan(t *testing.T) {
+	path, err := TmpRecipe("toml", `
+main = "t1"
+interp = ['bash', '-c', '{cmd}']
+
+[vars]
+name = "world"
+
+[resources]
+db = 1
+
+[tasks.t1]
+deps = ["t2", "t3", "t4", "t5"]
+cmd = "echo 'hello {name}'"
+
+[tasks.t2]
+requires = {db = 1}
+cmd = "echo t2"
+
+[tasks.t3]
+requires = {db = 1}
+cmd = "echo t3"
+
+[tasks.t4]
+
+[tasks.t5]
+cmd = "echo t5"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".timings")
+	state := `{"states": {"t5": "Success", "t1": "Failure"}}`
+	if err := ioutil.WriteFile(path+".state", []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path + ".state")
+
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Open(path, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetOrder(NameOrder)
+	p, err := r.PlanMain(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* t2 and t3 share the only database */
+	expected := `Main: t1
+Workers: 3
+Already done: t5
+Wave 1: t2, t4
+Wave 2: t3
+Wave 3: t1
+Commands:
+  t2: bash -c 'echo t2'
+  t4: (no cmd)
+  t3: bash -c 'echo t3'
+  t1: bash -c 'echo '\''hello world'\'''
+`
+	if p.String() != expected {
+		t.Errorf("Expected:\n%s\nNot:\n%s", expected, p)
+	}
+	var decoded Plan
+	if err := json.Unmarshal(p.JSON(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Tasks) != 4 || decoded.Tasks[3].Name != "t1" || decoded.Tasks[3].Wave != 3 ||
+		strings.Join(decoded.Tasks[3].Command, " ") != "bash -c echo 'hello world'" {
+		t.Errorf("Wrong JSON plan: %s", p.JSON())
+	}
+
+	/* Nothing is run nor saved */
+	if data, err := ioutil.ReadFile(path + ".state"); err != nil || string(data) != state {
+		t.Errorf("The state file was changed: %s", data)
+	}
+	if !(r.state.IsFailure("t1") && r.state.IsSuccess("t5") && !r.state.IsEnabled("t2")) {
+		t.Errorf("Wrong state: %v", r.state.String())
+	}
+}
@@ -0,0 +1,188 @@
+package recipe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DisposaBoy/JsonConfigReader"
+)
+
+/*
+ * Scheduling priority
+ *
+ * The ready tasks are dispatched by the length of the longest chain of
+ * enabled tasks that starts with them, so the long chains are not left for
+ * the end of the run. The cost of a task is its weight or, when it has
+ * none, how long it took the last time it succeeded. Unknown tasks cost one
+ * second. Ties, and the whole run with NameOrder, are sorted by name.
+ */
+
+type Order int
+
+const (
+	CriticalPathOrder Order = iota
+	NameOrder
+)
+
+/* Cost of the tasks without weight that have never succeeded */
+const defaultCost = 1.0
+
+// ParseOrder returns the Order with the given name: "critical" or "name".
+func ParseOrder(name string) (Order, error) {
+	switch strings.ToLower(name) {
+	case "critical", "critical-path", "":
+		return CriticalPathOrder, nil
+	case "name":
+		return NameOrder, nil
+	}
+	return CriticalPathOrder, fmt.Errorf("Unknown order: %s", name)
+}
+
+func (o Order) String() string {
+	if o == NameOrder {
+		return "name"
+	}
+	return "critical"
+}
+
+// SetOrder selects the order used to dispatch the ready tasks.
+func (r *Recipe) SetOrder(o Order) {
+	r.order = o
+}
+
+func (r *Recipe) Timings() *Timings {
+	return r.timings
+}
+
+func (r *Recipe) cost(n string, t *Task) float64 {
+	if t.Weight > 0 {
+		return t.Weight
+	}
+	if d, ok := r.timings.Duration(n); ok {
+		return d.Seconds()
+	}
+	return defaultCost
+}
+
+/* Length of the longest chain of enabled tasks that starts with each enabled task */
+func (r *Recipe) criticalPaths(enabled func(n string) bool) map[string]float64 {
+	dependents := make(map[string][]string)
+	for n, t := range r.Tasks {
+		if !enabled(n) {
+			continue
+		}
+		for _, d := range t.predecessors() {
+			dependents[d] = append(dependents[d], n)
+		}
+	}
+	paths := make(map[string]float64)
+	var path func(n string) float64
+	path = func(n string) float64 {
+		if p, ok := paths[n]; ok {
+			return p
+		}
+		longest := 0.0
+		for _, d := range dependents[n] {
+			if p := path(d); p > longest {
+				longest = p
+			}
+		}
+		paths[n] = r.cost(n, r.Tasks[n]) + longest
+		return paths[n]
+	}
+	for n := range r.Tasks {
+		if enabled(n) {
+			path(n)
+		}
+	}
+	return paths
+}
+
+/* Sorts the tasks by priority, or only by name if there are no priorities */
+func sortByPriority(namedTasks []*namedTask, priorities map[string]float64) {
+	sort.Slice(namedTasks, func(i, j int) bool {
+		pi, pj := priorities[namedTasks[i].n], priorities[namedTasks[j].n]
+		if pi != pj {
+			return pi > pj
+		}
+		return namedTasks[i].n < namedTasks[j].n
+	})
+}
+
+/***
+ * Timings
+ */
+
+// Timings keeps how long each task took the last time it succeeded. They
+// are stored next to the recipe, in path + ".timings", and survive the
+// removal of the state file.
+type Timings struct {
+	Durations map[string]float64 `json:"durations"`
+	path      string
+	logger    *Logger
+	mu        sync.RWMutex
+}
+
+// NewTimings creates empty timings that are only kept in memory.
+func NewTimings(logger *Logger) *Timings {
+	return &Timings{
+		Durations: make(map[string]float64),
+		logger:    logger,
+	}
+}
+
+func OpenTimings(path string, logger *Logger) (*Timings, error) {
+	ts := NewTimings(logger)
+	f, err := os.Open(path)
+	if err == nil {
+		defer f.Close()
+		err = json.NewDecoder(JsonConfigReader.New(f)).Decode(ts)
+		if err != nil {
+			return nil, fmt.Errorf("(%s) %s", path, err.Error())
+		}
+		if ts.Durations == nil {
+			ts.Durations = make(map[string]float64)
+		}
+		logger.Debug("Loading timings file: %s", path)
+	}
+	ts.path = path
+	return ts, nil
+}
+
+func (ts *Timings) Save() error {
+	if ts.path == "" {
+		return nil
+	}
+	ts.mu.RLock()
+	b, err := json.MarshalIndent(ts, "", "  ")
+	ts.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(ts.path, append(b, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	ts.logger.Debug("Saving timings file: %s", ts.path)
+	return nil
+}
+
+// Duration returns how long the task took the last time it succeeded.
+func (ts *Timings) Duration(taskName string) (time.Duration, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	s, ok := ts.Durations[taskName]
+	return time.Duration(s * float64(time.Second)), ok
+}
+
+func (ts *Timings) SetDuration(taskName string, d time.Duration) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.Durations[taskName] = d.Seconds()
+}
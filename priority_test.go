@@ -0,0 +1,89 @@
+package recipe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* The ready tasks are dispatched by critical path, or by name */
+func TestRecipe_priority(t *testing.T) {
+	txt := `
+main = "t"
+interp = ['bash', '-c', 'exec {cmd}']
+
+[tasks.t]
+deps = ["a", "b", "z3"]
+cmd = "echo t >> %[1]s"
+
+[tasks.a]
+cmd = "echo a >> %[1]s"
+
+[tasks.b]
+weight = 5
+cmd = "echo b >> %[1]s"
+
+[tasks.z1]
+cmd = "echo z1 >> %[1]s"
+
+[tasks.z2]
+deps = ["z1"]
+cmd = "echo z2 >> %[1]s"
+
+[tasks.z3]
+deps = ["z2"]
+cmd = "echo z3 >> %[1]s"
+`
+	name := "priority_output.txt"
+	defer os.Remove(name)
+	path, err := TmpRecipe("toml", fmt.Sprintf(txt, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	run := func(setup func(r *Recipe)) string {
+		os.Remove(name)
+		os.Remove(path + ".timings")
+		r, err := Open(path, logger, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setup(r)
+		/* A single worker runs the tasks in the order they are dispatched */
+		if err := r.RunMain(1); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(strings.Fields(string(data)), " ")
+	}
+
+	/* b is the heaviest chain, and then z1 -> z2 -> z3 */
+	if order := run(func(r *Recipe) {}); order != "b z1 z2 a z3 t" {
+		t.Errorf("Invalid critical path order: %s", order)
+	}
+	if order := run(func(r *Recipe) { r.SetOrder(NameOrder) }); order != "a b z1 z2 z3 t" {
+		t.Errorf("Invalid name order: %s", order)
+	}
+	/* Without weight, the duration of the last run is used */
+	if order := run(func(r *Recipe) { r.Timings().SetDuration("a", 4500*time.Millisecond) }); order != "b a z1 z2 z3 t" {
+		t.Errorf("Invalid order with timings: %s", order)
+	}
+	timings, err := OpenTimings(path+".timings", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := timings.Duration("a"); !ok || d >= 4500*time.Millisecond {
+		t.Errorf("The duration of the last run was not saved: %v", timings.Durations)
+	}
+}
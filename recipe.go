@@ -2,24 +2,56 @@ package recipe
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"io/ioutil"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/DisposaBoy/JsonConfigReader"
-	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v3"
 )
 
 type Recipe struct {
-	Main   string            `json:"main"`
-	Env    map[string]string `json:"env" toml:"env"`
-	Interp []string          `json:"interp" toml:"interp"`
-	Tasks  map[string]*Task  `json:"tasks"`
-	logger *Logger
-	state  *State
-	mu     sync.RWMutex
+	Main         Targets           `json:"main" yaml:"main"`
+	Env          map[string]string `json:"env" toml:"env" yaml:"env"`
+	Interp       []string          `json:"interp" toml:"interp" yaml:"interp"`
+	Vars         map[string]string `json:"vars" toml:"vars" yaml:"vars"`
+	Resources    map[string]int    `json:"resources" toml:"resources" yaml:"resources"`
+	Include      []string          `json:"include" toml:"include" yaml:"include"`
+	Import       map[string]string `json:"import" toml:"import" yaml:"import"`
+	Tasks        map[string]*Task  `json:"tasks" yaml:"tasks"`
+	Templates    map[string]*Task  `json:"templates" toml:"templates" yaml:"templates"`
+	Deadline     string            `json:"deadline" toml:"deadline" yaml:"deadline"`
+	CacheDir     string            `json:"cache" toml:"cache" yaml:"cache"`
+	CacheMaxSize string            `json:"cache_max_size" toml:"cache_max_size" yaml:"cache_max_size"`
+	OnSuccess    []string          `json:"on_success" toml:"on_success" yaml:"on_success"`
+	OnFailure    []string          `json:"on_failure" toml:"on_failure" yaml:"on_failure"`
+	Finally      []string          `json:"finally" toml:"finally" yaml:"finally"`
+	dir          string
+	positions    map[string]position
+	overrides    map[string]string
+	runID        string
+	included     bool
+	checked      bool
+	finished     bool
+	order        Order
+	keepGoing    bool
+	force        bool
+	retryAt      map[string]time.Time
+	tasksCtx     context.Context
+	cancelTasks  context.CancelCauseFunc
+	deadline     *time.Duration
+	logger       *Logger
+	state        *State
+	timings      *Timings
+	fingerprints *Fingerprints
+	cache        *Cache
+	mu           sync.RWMutex
 }
 
 type namedTask struct {
@@ -32,80 +64,288 @@ type result struct {
 	e error
 }
 
-func Open(path string, recipeLogger, stateLogger *Logger) (*Recipe, error) {
-	var r Recipe
-	f, err := os.Open(path)
+var errUnknownFormat = errors.New("Unknown filetype")
+
+/* Cause of the cancellation of the running tasks after a failure */
+var errCancelled = errors.New("Cancelled after a failure")
+
+// Open loads the recipe stored in path. The format is chosen by the file
+// extension, or sniffed from the content when the extension is unknown.
+// The state is kept next to the recipe, in path + ".state". The options,
+// like WithVar, are applied before checking the recipe.
+func Open(path string, recipeLogger, stateLogger *Logger, opts ...Option) (*Recipe, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("(%s) %s", path, err.Error())
 	}
+	format := FormatFromPath(path)
+	if format == UnknownFormat {
+		format = SniffFormat(data)
+	}
+	r, err := load(data, format, path, path+".state", recipeLogger, stateLogger, opts...)
+	if err != nil {
+		return nil, withFile(path, err)
+	}
+	return r, nil
+}
+
+// Parse loads a recipe from rd. When format is UnknownFormat it is sniffed
+// from the content. As there is no file to store it, the state of the
+// recipe is only kept in memory. The options are applied as in Open.
+func Parse(rd io.Reader, format Format, recipeLogger, stateLogger *Logger, opts ...Option) (*Recipe, error) {
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	if format == UnknownFormat {
+		format = SniffFormat(data)
+	}
+	return load(data, format, "", "", recipeLogger, stateLogger, opts...)
+}
+
+// CheckFile loads and validates the recipe in path, as Open does, but
+// without reading or writing its state.
+func CheckFile(path string, logger *Logger) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("(%s) %s", path, err.Error())
+	}
+	format := FormatFromPath(path)
+	if format == UnknownFormat {
+		format = SniffFormat(data)
+	}
+	if _, err := load(data, format, path, "", logger, logger); err != nil {
+		return withFile(path, err)
+	}
+	return nil
+}
 
-	/* Guess type of file and decode it */
-	ext := filepath.Ext(path)
-	if ext == ".json" {
-		err = json.NewDecoder(JsonConfigReader.New(f)).Decode(&r)
+func load(data []byte, format Format, path, statePath string, recipeLogger, stateLogger *Logger, opts ...Option) (*Recipe, error) {
+	var r Recipe
+	ds, err := decode(data, format, &r)
+	if err != nil {
+		return nil, err
+	}
+
+	// NOTE: Create the rest of Recipe fields after the decoding step
+
+	/* Build the final list of tasks */
+	r.dir = "."
+	stack := []string{}
+	if path != "" {
+		r.dir = filepath.Dir(path)
+		abs, err := filepath.Abs(path)
 		if err != nil {
-			return nil, fmt.Errorf("(%s) %s", path, err.Error())
+			return nil, err
 		}
-	} else if ext == ".toml" {
-		err = toml.NewDecoder(f).Decode(&r)
+		stack = append(stack, abs)
+	}
+	if path != "" {
+		r.setPositionsFile(path)
+	}
+	if err := r.resolve(r.dir, stack); err != nil {
+		return nil, ds.join(err)
+	}
+	r.overrideVarsFromEnv()
+
+	/* Open state */
+	if statePath != "" {
+		r.state, err = OpenState(statePath, stateLogger)
 		if err != nil {
-			return nil, fmt.Errorf("(%s) %s", path, err.Error())
+			return nil, err
 		}
 	} else {
-		// TODO: Implement a modeline mechanism? // -*- coding: utf-8; mode: json; -*-
-		return nil, fmt.Errorf("(%s) Unknown filetype", path)
+		r.state = NewState(stateLogger)
 	}
 
-	// NOTE: Create the rest of Recipe fields after the decoding step
+	/* Open timings, kept even when the state file is removed */
+	if statePath != "" && path != "" {
+		r.timings, err = OpenTimings(path+".timings", stateLogger)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		r.timings = NewTimings(stateLogger)
+	}
 
-	/* Open state */
-	r.state, err = OpenState(path+".state", stateLogger)
-	if err != nil {
-		return nil, err
+	/* Open fingerprints, also kept when the state file is removed */
+	if statePath != "" && path != "" {
+		r.fingerprints, err = OpenFingerprints(path+".fingerprints", stateLogger)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		r.fingerprints = NewFingerprints(stateLogger)
 	}
 
 	/* Set logger */
 	r.logger = recipeLogger
+	r.cache = r.openCache()
+	for _, opt := range opts {
+		if err := opt(&r); err != nil {
+			return nil, err
+		}
+	}
 	r.logger.Debug("Recipe: %s", r.PrettyString())
 
-	/* Check the recipe */
-	if err := r.check(); err != nil {
-		return nil, fmt.Errorf("(%s) %s", path, err.Error())
+	/* Check the recipe, even if it has schema errors, to report every problem */
+	if err := r.check(); err != nil || len(ds) > 0 {
+		return nil, ds.join(err)
 	}
+	r.checked = true
 	return &r, nil
 }
 
+// resolve merges the tasks of other recipes, and then inherits the fields of
+// extended tasks and expands the matrices.
+func (r *Recipe) resolve(dir string, stack []string) error {
+	if err := r.resolveIncludes(dir, stack); err != nil {
+		return err
+	}
+	if err := r.resolveExtends(); err != nil {
+		return err
+	}
+	if err := r.expandMatrices(); err != nil {
+		return err
+	}
+	for n, t := range r.Tasks {
+		t.name = n
+	}
+	return nil
+}
+
+/*
+ * Collects every semantic error of the recipe, at the position of the task
+ * or key it is about
+ */
+type checker struct {
+	r  *Recipe
+	ds Diagnostics
+}
+
+func (c *checker) task(n string, err error) {
+	if err != nil {
+		c.ds = append(c.ds, c.r.Tasks[n].pos.diagnostic(err))
+	}
+}
+
+func (c *checker) key(key string, err error) {
+	if err != nil {
+		c.ds = append(c.ds, c.r.positions[key].diagnostic(err))
+	}
+}
+
 func (r *Recipe) check() error {
 	if len(r.Tasks) <= 0 {
 		r.logger.Warning("Empty list of tasks")
 		return nil
 	}
-	for n, t := range r.Tasks {
-		if t.Cmd == "" {
-			r.logger.Warning("In task '%s': No cmd", n)
+	c := &checker{r: r}
+	for _, n := range r.taskNames() {
+		t := r.Tasks[n]
+		if strings.TrimSpace(t.Cmd) == "" && !t.aggregate {
+			if t.cmdPos.Line > 0 {
+				r.logger.Warning("%s", t.cmdPos.diagnostic(fmt.Errorf("In task '%s': Empty cmd", n)))
+			} else {
+				r.logger.Warning("%s", t.pos.diagnostic(fmt.Errorf("In task '%s': No cmd", n)))
+			}
 		}
+		if t.Weight < 0 {
+			c.task(n, fmt.Errorf("In task '%s': Negative weight: %g", n, t.Weight))
+		}
+		c.task(n, t.checkRetries())
+		if _, err := parseDuration(t.Timeout); err != nil {
+			c.task(n, fmt.Errorf("In task '%s': Invalid timeout: %s", n, err.Error()))
+		}
+		c.task(n, r.checkConditions(n, t))
+		c.task(n, checkPatterns(n, "inputs", t.Inputs))
+		c.task(n, checkPatterns(n, "outputs", t.Outputs))
 		for _, d := range t.Deps {
 			if _, ok := r.Tasks[d]; !ok {
-				return fmt.Errorf("In task '%s': Unknown referenced task: %s", n, d)
+				c.task(n, fmt.Errorf("In task '%s': Unknown referenced task: %s", n, d))
+			}
+		}
+		for _, a := range t.After {
+			if _, ok := r.Tasks[a]; !ok {
+				c.task(n, fmt.Errorf("In task '%s': Unknown referenced task in after: %s", n, a))
 			}
 		}
 	}
-	if r.Main == "" {
+	if cycles := r.cycles(); len(cycles) > 0 {
+		c.task(cycles[0][0], &CycleError{cycles})
+	}
+	r.checkVars(c)
+	r.checkResources(c)
+	if _, err := parseDuration(r.Deadline); err != nil {
+		c.key("deadline", fmt.Errorf("Invalid deadline: %s", err.Error()))
+	}
+	if r.CacheMaxSize != "" {
+		if _, err := ParseSize(r.CacheMaxSize); err != nil {
+			c.key("cache_max_size", fmt.Errorf("Invalid cache_max_size: %s", err.Error()))
+		}
+	}
+	r.checkHooks(c)
+	if len(r.Main) == 0 {
 		r.logger.Warning("No main task")
 	}
-	if _, ok := r.Tasks[r.Main]; !ok {
-		return fmt.Errorf("Unknown referenced main task: %s", r.Main)
+	c.key("main", r.checkTargets(r.Main))
+	if len(c.ds) > 0 {
+		return c.ds
+	}
+	return nil
+}
+
+func (r *Recipe) checkTargets(targets Targets) error {
+	for _, n := range targets {
+		if _, ok := r.Tasks[n]; !ok {
+			return fmt.Errorf("Unknown referenced main task: %s", n)
+		}
 	}
 	return nil
 }
 
 func (r *Recipe) RunMain(numWorkers uint) error {
-	return r.run(numWorkers)
+	return r.RunMainContext(context.Background(), numWorkers)
 }
 
 func (r *Recipe) RunTask(task string, numWorkers uint) error {
-	r.Main = task
-	return r.run(numWorkers)
+	return r.RunTaskContext(context.Background(), task, numWorkers)
+}
+
+// RunTasks runs several tasks, and their dependencies, in the same run. It
+// only succeeds when all of them succeed.
+func (r *Recipe) RunTasks(tasks []string, numWorkers uint) error {
+	return r.RunTasksContext(context.Background(), tasks, numWorkers)
+}
+
+// RunMainContext runs the main tasks like RunMain. When ctx is done, the
+// running tasks are terminated and marked as Cancelled, and the state is
+// saved to resume the recipe later.
+//
+// After a failure or an interruption no other task is started, unless it
+// keeps going with SetKeepGoing, and it only returns once every running task
+// has exited. The failures are returned as Errors.
+func (r *Recipe) RunMainContext(ctx context.Context, numWorkers uint) error {
+	return r.run(ctx, r.Main, numWorkers)
+}
+
+// RunTaskContext runs a task like RunTask, and stops like RunMainContext
+// when ctx is done.
+func (r *Recipe) RunTaskContext(ctx context.Context, task string, numWorkers uint) error {
+	return r.run(ctx, Targets{task}, numWorkers)
+}
+
+// RunTasksContext runs several tasks like RunTasks, and stops like
+// RunMainContext when ctx is done.
+func (r *Recipe) RunTasksContext(ctx context.Context, tasks []string, numWorkers uint) error {
+	return r.run(ctx, Targets(tasks), numWorkers)
+}
+
+// SetKeepGoing selects whether the tasks that do not depend on a failed
+// one keep running after a failure. The tasks that depend on it are marked
+// as Blocked, and every failure is returned at the end as Errors.
+func (r *Recipe) SetKeepGoing(keepGoing bool) {
+	r.keepGoing = keepGoing
 }
 
 func (r *Recipe) enableTasks(name string) error {
@@ -113,7 +353,8 @@ func (r *Recipe) enableTasks(name string) error {
 	if !ok {
 		return fmt.Errorf("The task is not defined in the recipe: %s", name)
 	}
-	if !r.state.IsDone(name) {
+	/* Failed tasks are run again when resuming */
+	if !r.state.IsSuccess(name) {
 		r.state.SetDisabled(name)
 		r.state.MustSetEnabled(name)
 		r.logger.Debug("Enabled: %s", name)
@@ -123,140 +364,347 @@ func (r *Recipe) enableTasks(name string) error {
 	for _, n := range t.Deps {
 		err := r.enableTasks(n)
 		if err != nil {
-			return nil
+			return err
 		}
 	}
 	return nil
 }
 
-func (r *Recipe) countEnabled() int {
-	i := 0
-	for n := range r.Tasks {
-		if r.state.IsEnabled(n) {
-			i++
-		}
+func (r *Recipe) run(ctx context.Context, targets Targets, numWorkers uint) error {
+	if err := r.checkRun(targets, numWorkers); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.runID = newRunID()
+	r.mu.Unlock()
+	r.retryAt = make(map[string]time.Time)
+	defer r.trimCache()
+	/* As the state file, the state of a finished run is not resumed */
+	if r.finished {
+		r.state.reset()
+		r.finished = false
+	}
+	r.logger.Info("Main: %s", targets)
+	r.logger.Info("Workers: %d", numWorkers)
+	runCtx, cancel := r.withDeadline(ctx)
+	defer cancel()
+	err := r.schedule(runCtx, targets, numWorkers)
+	var hooksErr error
+	if hooks := r.hooks(targets, err != nil); len(hooks) > 0 {
+		/* The hooks are run even if the run was interrupted or reached the deadline */
+		hooksErr = r.runHooks(context.WithoutCancel(ctx), hooks, numWorkers)
+	}
+	if err == nil {
+		/*
+		 * Remove the state file if all the tasks have terminated correctly.
+		 * The hooks are not resumed, so their failures do not keep it.
+		 */
+		r.state.Remove()
+		r.finished = true
 	}
-	return i
+	if hooksErr != nil {
+		return &HooksError{err, hooksErr}
+	}
+	return err
 }
 
-func (r *Recipe) run(numWorkers uint) error {
-	r.logger.Info("Main: %s", r.Main)
-	r.logger.Info("Workers: %d", numWorkers)
-	err := r.enableTasks(r.Main)
-	if err != nil {
-		return err
+/* Runs the targets and their dependencies that are not done yet */
+func (r *Recipe) schedule(ctx context.Context, targets Targets, numWorkers uint) error {
+	for _, n := range targets {
+		if err := r.enableTasks(n); err != nil {
+			return err
+		}
 	}
+	/* Tasks are only sent to free workers, so none is queued when the run stops */
+	namedTaskCh := make(chan *namedTask)
 	resultCh := make(chan *result, numWorkers)
-	namedTaskCh := make(chan *namedTask, r.countEnabled())
-	doneCh := make(chan error)
-	dispatchAgainCh := make(chan bool)
-	go r.producer(namedTaskCh, dispatchAgainCh)
+	/* Cancelled after a failure, to stop the tasks at any point of their execution */
+	tasksCtx, cancelTasks := context.WithCancelCause(ctx)
+	defer cancelTasks(nil)
+	r.tasksCtx, r.cancelTasks = tasksCtx, cancelTasks
+	var consumers sync.WaitGroup
 	for i := uint(0); i < numWorkers; i++ {
-		go r.consumer(i, resultCh, namedTaskCh)
+		consumers.Add(1)
+		go func(id uint) {
+			defer consumers.Done()
+			r.consumer(tasksCtx, id, resultCh, namedTaskCh)
+		}(i)
 	}
-	go r.validator(resultCh, dispatchAgainCh, doneCh)
-	return <-doneCh
+	err := r.scheduler(ctx, targets, numWorkers, namedTaskCh, resultCh)
+	close(namedTaskCh)
+	consumers.Wait()
+	return err
 }
 
-func (r *Recipe) consumer(id uint, resultCh chan<- *result, namedTaskCh <-chan *namedTask) {
+func (r *Recipe) consumer(ctx context.Context, id uint, resultCh chan<- *result, namedTaskCh <-chan *namedTask) {
 	//r.logger.Debug("Starting consumer %d", id)
 	for nt := range namedTaskCh {
+		/* Do not start the tasks dispatched just before an interruption */
+		if err := ctx.Err(); err != nil {
+			resultCh <- &result{nt.n, err}
+			continue
+		}
 		r.state.MustSetRunning(nt.n)
 		r.logger.Debug("Running: %s", nt.n)
-		err := nt.t.Execute(r)
+		start := time.Now()
+		err := r.execute(ctx, nt.t)
+		r.state.setEnded(nt.n)
+		if err == nil {
+			r.timings.SetDuration(nt.n, time.Since(start))
+		}
 		resultCh <- &result{nt.n, err}
 	}
 	//r.logger.Debug("Stopping consumer %d", id)
 }
 
-func (r *Recipe) producer(namedTaskCh chan<- *namedTask, dispatchAgainCh <-chan bool) {
-	//r.logger.Debug("Starting producer")
-	for {
-		r.logger.Debug("Searching ready tasks")
-		it := r.readyTasks()
-		for n, t := it.next(); t != nil; n, t = it.next() {
-			r.state.MustSetWaiting(n)
-			r.logger.Debug("Waiting: %s", n)
-			namedTaskCh <- &namedTask{n, t}
+/*
+ * Runs the task if its conditions are met and its outputs are not up to
+ * date. The timeout covers all of it, not only the cmd.
+ */
+func (r *Recipe) execute(ctx context.Context, t *Task) error {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+	et, err := r.expandTask(t.name, t)
+	if err != nil {
+		return err
+	}
+	if et.cmd != "" {
+		r.state.setCommand(t.name, t.commandFingerprint(et))
+	}
+	if err := t.evalConditions(ctx, r, et); err != nil {
+		return err
+	}
+	if len(et.outputs) == 0 {
+		return t.executeContext(ctx, r, nil)
+	}
+	upToDate, fp, err := r.upToDate(t.name, t, et)
+	if err != nil {
+		return err
+	}
+	if upToDate {
+		return &skippedError{upToDateReason}
+	}
+	var output *capturedOutput
+	if r.cache != nil {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		if !<-dispatchAgainCh {
-			//r.logger.Debug("Stopping producer")
-			close(namedTaskCh)
-			return
+		if !r.force && r.restoreCached(t.name, et, fp) {
+			r.fingerprints.SetFingerprint(t.name, fp)
+			return nil
 		}
+		output = &capturedOutput{}
+	}
+	if err := t.executeContext(ctx, r, output); err != nil {
+		return err
+	}
+	if output != nil {
+		r.storeCached(t.name, et, fp, output)
 	}
+	r.fingerprints.SetFingerprint(t.name, fp)
+	return nil
 }
 
-func (r *Recipe) validator(resultCh <-chan *result, dispatchAgainCh chan<- bool, doneCh chan<- error) {
-	//r.logger.Debug("Starting validator")
+/*
+ * Dispatches the ready tasks to the free workers until the main tasks are
+ * done. After a failure, unless keeping going, or an interruption nothing
+ * else is dispatched, and it waits for the running tasks to exit before
+ * returning.
+ */
+func (r *Recipe) scheduler(ctx context.Context, targets Targets, numWorkers uint, namedTaskCh chan<- *namedTask, resultCh <-chan *result) error {
+	failures := Errors{}
+	var interrupted error
+	ctxDone := ctx.Done()
+	running := uint(0)
+	available := r.newPools()
+	var priorities map[string]float64
+	if r.order == CriticalPathOrder {
+		priorities = r.criticalPaths(r.state.IsEnabled)
+	}
+	/* The timings of the tasks that succeeded are kept even if the run fails */
+	defer r.timings.Save()
+	defer r.fingerprints.Save()
 	for {
-		result := <-resultCh
-		if result.e != nil {
-			if r.Tasks[result.n].AllowFailure {
-				r.logger.Info("Allowed Failure: %s", result.n)
-				goto success
+		stopped := (len(failures) > 0 && !r.keepGoing) || interrupted != nil
+		if !stopped {
+			r.logger.Debug("Searching ready tasks")
+			it := r.readyTasks(priorities)
+			for n, t := it.next(); t != nil && running < numWorkers; n, t = it.next() {
+				if at, ok := r.retryAt[n]; ok && time.Now().Before(at) {
+					continue
+				}
+				if !available.fits(t) {
+					r.logger.Debug("Not enough resources: %s", n)
+					continue
+				}
+				delete(r.retryAt, n)
+				available.acquire(t)
+				r.state.MustSetWaiting(n)
+				r.logger.Debug("Waiting: %s", n)
+				namedTaskCh <- &namedTask{n, t}
+				running++
 			}
-			if r.state.IsCancelled(result.n) {
-				r.logger.Debug("Cancellation confirmed: %s", result.n)
-				goto save
+		}
+		/* The pending retries are abandoned when stopping */
+		if running == 0 && (stopped || len(r.retryAt) == 0) {
+			break
+		}
+		var retryTimer <-chan time.Time
+		if d, ok := r.nextRetry(); ok && !stopped {
+			retryTimer = time.After(d)
+		}
+		select {
+		case <-retryTimer:
+		case <-ctxDone:
+			ctxDone = nil
+			interrupted = context.Cause(ctx)
+			r.logger.Warning("Interrupted: %s", interrupted.Error())
+			r.onInterrupt(isTimeout(interrupted))
+		case result := <-resultCh:
+			running--
+			available.release(r.Tasks[result.n])
+			if err := r.onResult(result, interrupted != nil); err != nil {
+				failures = append(failures, err)
 			}
-			r.logger.Debug("Failure: %s", result.n)
-			// Cancel all the running tasks
-			r.onFailure(result.n)
-			// Terminate dispatcher
-			dispatchAgainCh <- false
-			// Terminate
-			doneCh <- (*Error)(result)
-			goto save
+			/* Save the state after any terminated task */
+			r.state.Save()
+		}
+	}
+
+	switch {
+	case len(failures) > 0:
+		return failures
+	case isTimeout(interrupted):
+		return interrupted
+	case interrupted != nil:
+		return fmt.Errorf("Interrupted: %w", interrupted)
+	}
+	for _, n := range targets {
+		if !r.state.IsSatisfied(n) {
+			return fmt.Errorf("Unable to run the main task: %s", n)
 		}
+	}
+	return nil
+}
+
+/* Records the final state of a task, and returns its error if it failed */
+func (r *Recipe) onResult(result *result, interrupted bool) *Error {
+	var skipped *skippedError
+	switch {
+	case r.state.IsCancelled(result.n), r.state.IsTimedOut(result.n):
+		r.logger.Debug("Cancellation confirmed: %s", result.n)
+	case !r.state.IsRunning(result.n):
+		r.logger.Debug("Not started: %s", result.n)
+	case result.e == nil:
 		r.logger.Debug("Success: %s", result.n)
-		if result.n == r.Main {
-			r.onSuccess(result.n)
-			/* Remove the state file if all the tasks have terminated correctly */
-			r.state.Remove()
-			dispatchAgainCh <- false
-			doneCh <- nil
-			break
+		r.onSuccess(result.n)
+	case errors.As(result.e, &skipped):
+		r.logger.Info("Skipped: %s (%s)", result.n, skipped.reason)
+		r.state.MustSetSkipped(result.n)
+	case interrupted:
+		r.logger.Debug("Cancellation confirmed: %s", result.n)
+		if isTimeout(result.e) {
+			r.state.MustSetTimedOut(result.n)
+		} else {
+			r.state.MustSetCancelled(result.n)
 		}
-	success:
+	case errors.Is(context.Cause(r.tasksCtx), errCancelled):
+		/* Started while handling a failure, so it was not cancelled by it but ran with a cancelled context */
+		r.logger.Debug("Cancellation confirmed: %s", result.n)
+		r.state.MustSetCancelled(result.n)
+	case r.retry(result):
+		/* Enabled again to be dispatched after the delay */
+	case r.Tasks[result.n].allowsFailure():
+		r.logger.Info("Allowed Failure: %s", result.n)
 		r.onSuccess(result.n)
-		dispatchAgainCh <- true
-	save:
-		/* Save the state after any terminated task */
-		r.state.Save()
+	default:
+		r.logger.Debug("Failure: %s", result.n)
+		// Cancel all the running tasks
+		r.onFailure(result.n, result.e)
+		return (*Error)(result)
+	}
+	return nil
+}
+
+/* The running tasks are terminated by the context */
+func (r *Recipe) onInterrupt(timedOut bool) {
+	for n := range r.Tasks {
+		if r.state.IsRunning(n) {
+			r.logger.Debug("Cancellation requested: %s", n)
+			if timedOut {
+				r.state.MustSetTimedOut(n)
+			} else {
+				r.state.MustSetCancelled(n)
+			}
+		}
 	}
-	//r.logger.Debug("Stopping validator")
 }
 
 func (r *Recipe) onSuccess(name string) {
 	r.state.MustSetSuccess(name)
 }
 
-func (r *Recipe) onFailure(name string) {
-	for n, t := range r.Tasks {
+func (r *Recipe) onFailure(name string, err error) {
+	if r.keepGoing {
+		r.setFailure(name, err)
+		r.blockDependents(name)
+		return
+	}
+	for n := range r.Tasks {
 		if n != name {
 			if r.state.IsRunning(n) {
 				r.logger.Debug("Cancellation requested: %s", n)
 				r.state.MustSetCancelled(n)
-				err := t.Terminate()
-				if err != nil {
-					r.logger.Error("Unable to terminate '%s': %s", n, err.Error())
-				}
 			}
 		} else {
-			r.state.MustSetFailure(n)
+			r.setFailure(n, err)
+		}
+	}
+	/* The running tasks are terminated by their context, even if they have not started their cmd */
+	r.cancelTasks(errCancelled)
+}
+
+func (r *Recipe) setFailure(name string, err error) {
+	if isTimeout(err) {
+		r.state.MustSetTimedOut(name)
+	} else {
+		r.state.MustSetFailure(name)
+	}
+}
+
+/* Only the tasks that depend on a failed one are not run when keeping going */
+func (r *Recipe) blockDependents(name string) {
+	for _, n := range r.taskNames() {
+		if !r.state.IsEnabled(n) {
+			continue
+		}
+		for _, d := range r.Tasks[n].Deps {
+			if d == name {
+				r.logger.Warning("Blocked by '%s': %s", name, n)
+				r.state.MustSetBlocked(n)
+				r.blockDependents(n)
+				break
+			}
 		}
 	}
 }
 
-func (r *Recipe) readyTasks() *TaskIterator {
+/* Ready tasks, sorted by priority */
+func (r *Recipe) readyTasks(priorities map[string]float64) *TaskIterator {
 	namedTasks := make([]*namedTask, 0)
 	for n, t := range r.Tasks {
 		if r.readyTask(n, t) {
-			r.logger.Debug("Ready: %s", n)
 			namedTasks = append(namedTasks, &namedTask{n, t})
 		}
 	}
+	sortByPriority(namedTasks, priorities)
+	for _, nt := range namedTasks {
+		if priorities != nil {
+			r.logger.Debug("Ready: %s (priority %g)", nt.n, priorities[nt.n])
+		} else {
+			r.logger.Debug("Ready: %s", nt.n)
+		}
+	}
 	return &TaskIterator{namedTasks, -1}
 }
 
@@ -265,7 +713,13 @@ func (r *Recipe) readyTask(n string, t *Task) bool {
 		return false
 	}
 	for _, d := range t.Deps {
-		if !r.state.IsSuccess(d) {
+		if !r.state.IsSatisfied(d) {
+			return false
+		}
+	}
+	/* Only the tasks that are also part of the run are waited */
+	for _, a := range t.After {
+		if r.state.IsPending(a) {
 			return false
 		}
 	}
@@ -307,6 +761,42 @@ func (r *Recipe) serialize(indent bool) *bytes.Buffer {
 	return &b
 }
 
+/*
+ * Targets
+ */
+
+// Targets are the names of the main tasks. In a recipe they can be written
+// as a list or, when there is only one, as a string.
+type Targets []string
+
+func (ts Targets) String() string {
+	return strings.Join(ts, ", ")
+}
+
+func (ts Targets) MarshalJSON() ([]byte, error) {
+	if len(ts) == 1 {
+		return json.Marshal(ts[0])
+	}
+	return json.Marshal([]string(ts))
+}
+
+func (ts *Targets) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*ts = Targets{name}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(ts))
+}
+
+func (ts *Targets) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		*ts = Targets{n.Value}
+		return nil
+	}
+	return n.Decode((*[]string)(ts))
+}
+
 /*
  * Task Iterator
  */
@@ -337,3 +827,32 @@ type Error struct {
 func (e *Error) Error() string {
 	return fmt.Sprintf("(%s) %s", e.n, e.e.Error())
 }
+
+// Task returns the name of the failed task.
+func (e *Error) Task() string {
+	return e.n
+}
+
+func (e *Error) Unwrap() error {
+	return e.e
+}
+
+// Errors holds the errors of the tasks that failed in a run, in the order
+// they failed.
+type Errors []*Error
+
+func (es Errors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (es Errors) Unwrap() []error {
+	errs := make([]error, len(es))
+	for i, e := range es {
+		errs[i] = e
+	}
+	return errs
+}
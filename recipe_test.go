@@ -1,12 +1,17 @@
 package recipe
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -58,6 +63,48 @@ func TestRecipe_basic_JSON(t *testing.T) {
 `, "json", WarningL)
 }
 
+func TestRecipe_basic_YAML(t *testing.T) {
+	testBasic(t, `
+main: t1
+interp: [bash, -c, "exec {cmd}"]
+
+tasks:
+  t1:
+    deps: [t2]
+    cmd: echo t1 >> %[1]s
+  t2:
+    deps: [t3]
+    cmd: echo t2 >> %[1]s
+  t3:
+    deps: []
+    cmd: echo t3 >> %[1]s
+`, "yaml", WarningL)
+}
+
+/*
+Share task fragments with YAML anchors and aliases
+*/
+
+func TestRecipe_anchors_YAML(t *testing.T) {
+	testBasic(t, `
+main: t1
+
+tasks:
+  t1: &base
+    interp: [bash, -c, "exec {cmd}"]
+    deps: [t2]
+    cmd: echo t1 >> %[1]s
+  t2:
+    <<: *base
+    deps: [t3]
+    cmd: echo t2 >> %[1]s
+  t3:
+    <<: *base
+    deps: []
+    cmd: echo t3 >> %[1]s
+`, "yaml", WarningL)
+}
+
 func testBasic(t *testing.T, txt, format string, logLevel LoggerLevel) {
 	/* Create tmp file */
 	name := "basic_output.txt"
@@ -73,6 +120,7 @@ func testBasic(t *testing.T, txt, format string, logLevel LoggerLevel) {
 	}
 	defer os.Remove(path)
 	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
 
 	/* Run recipe */
 	logger := NewLogger("[Test] ")
@@ -82,7 +130,7 @@ func testBasic(t *testing.T, txt, format string, logLevel LoggerLevel) {
 		t.Errorf("Loading recipe: %s", err)
 		return
 	}
-	err = r.RunMain(uint(runtime.NumCPU()))
+	err = r.RunMain(testWorkers())
 	if err != nil {
 		t.Errorf("Running recipe: %s", err)
 		return
@@ -106,6 +154,81 @@ func testBasic(t *testing.T, txt, format string, logLevel LoggerLevel) {
 	}
 }
 
+/*
+Load recipes from a reader guessing their format
+*/
+
+func TestRecipe_parse_TOML(t *testing.T) {
+	testParse(t, `
+main = "t1"
+interp = ['bash', '-c', 'exec {cmd}']
+
+[tasks.t1]
+deps = ["t2"]
+cmd = "echo t1"
+
+[tasks.t2]
+cmd = "echo t2"
+`)
+}
+
+func TestRecipe_parse_JSON(t *testing.T) {
+	testParse(t, `
+/* Comment */
+{
+	"main": "t1",
+	"interp": ["bash", "-c", "exec {cmd}"],
+	"tasks": {
+		"t1": {
+			"deps": ["t2"],
+			"cmd": "echo t1",
+		},
+		"t2": {
+			"cmd": "echo t2",
+		}
+	}
+}
+`)
+}
+
+func TestRecipe_parse_YAML(t *testing.T) {
+	testParse(t, `
+main: t1
+interp: [bash, -c, "exec {cmd}"]
+tasks:
+  t1:
+    deps: [t2]
+    cmd: echo t1
+  t2:
+    cmd: echo t2
+`)
+}
+
+func TestRecipe_parse_modeline(t *testing.T) {
+	testParse(t, `# -*- mode: yaml -*-
+{main: t1, interp: [bash, -c, "exec {cmd}"], tasks: {t1: {deps: [t2], cmd: echo t1}, t2: {cmd: echo t2}}}
+`)
+}
+
+func testParse(t *testing.T, txt string) {
+	logger := NewLogger("[Test] ")
+	logger.Level = WarningL
+	r, err := Parse(strings.NewReader(txt), UnknownFormat, logger, logger)
+	if err != nil {
+		t.Errorf("Loading recipe: %s", err)
+		return
+	}
+	err = r.RunMain(testWorkers())
+	if err != nil {
+		t.Errorf("Running recipe: %s", err)
+		return
+	}
+	if !(r.state.IsSuccess("t1") && r.state.IsSuccess("t2")) {
+		t.Errorf("Wrong state: %v", r.state.String())
+		return
+	}
+}
+
 /*
 Abort the rest of tasks when any task fail
 */
@@ -152,6 +275,24 @@ func TestRecipe_cancel_JSON(t *testing.T) {
 `, "json", WarningL)
 }
 
+func TestRecipe_cancel_YAML(t *testing.T) {
+	testCancel(t, `
+main: t1
+interp: [bash, -c, "{cmd}"]
+
+tasks:
+  t1:
+    deps: [t2]
+    cmd: echo t1 >> %[1]s
+  t2:
+    deps: [t3]
+    cmd: "false"
+  t3:
+    deps: []
+    cmd: echo t3 >> %[1]s
+`, "yaml", WarningL)
+}
+
 /*
 Cancel running tasks when any task fail
 */
@@ -198,6 +339,24 @@ func TestRecipe_cancelRunning_JSON(t *testing.T) {
 `, "json", DebugL)
 }
 
+func TestRecipe_cancelRunning_YAML(t *testing.T) {
+	testCancel(t, `
+main: t1
+interp: [bash, -c, "{cmd}"]
+
+tasks:
+  t1:
+    deps: [t2, t3]
+    cmd: echo t1 >> %[1]s
+  t2:
+    deps: []
+    cmd: sleep 1 && false
+  t3:
+    deps: []
+    cmd: echo t3 >> %[1]s && sleep 10 && echo FOO >> %[1]s
+`, "yaml", DebugL)
+}
+
 func testCancel(t *testing.T, txt, format string, logLevel LoggerLevel) {
 	/* Create tmp file */
 	name := "cancel_output.txt"
@@ -212,6 +371,7 @@ func testCancel(t *testing.T, txt, format string, logLevel LoggerLevel) {
 	}
 	defer os.Remove(path)
 	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
 
 	/* Run recipe */
 	logger := NewLogger("[Test] ")
@@ -221,7 +381,7 @@ func testCancel(t *testing.T, txt, format string, logLevel LoggerLevel) {
 		t.Errorf("Loading recipe: %s", err)
 		return
 	}
-	err = r.RunMain(uint(runtime.NumCPU()))
+	err = r.RunMain(testWorkers())
 	if err == nil {
 		t.Error("Expected failure, not success")
 		return
@@ -248,6 +408,700 @@ func testCancel(t *testing.T, txt, format string, logLevel LoggerLevel) {
 	}
 }
 
+/* A task that starts while a failure is being handled is cancelled, not retried nor failed */
+func TestRecipe_cancelStarting(t *testing.T) {
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := NewRecipe(WithMain("t1", "t2"), WithLogger(logger), WithMemoryState(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddTask("t1", &Task{Cmd: "false"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddTask("t2", &Task{Cmd: "true", Retries: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Check(); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{"t1", "t2"} {
+		if err := r.enableTasks(n); err != nil {
+			t.Fatal(err)
+		}
+		r.state.MustSetWaiting(n)
+	}
+	tasksCtx, cancelTasks := context.WithCancelCause(context.Background())
+	defer cancelTasks(nil)
+	r.tasksCtx, r.cancelTasks = tasksCtx, cancelTasks
+
+	r.state.MustSetRunning("t1")
+	if err := r.onResult(&result{"t1", errors.New("exit status 1")}, false); err == nil {
+		t.Fatal("Expected t1 failure")
+	}
+	/* t2 was received by a worker before the failure, but only starts now */
+	r.state.MustSetRunning("t2")
+	if err := r.onResult(&result{"t2", context.Canceled}, false); err != nil {
+		t.Errorf("Unexpected failure: %s", err)
+	}
+	if !(r.state.IsFailure("t1") && r.state.IsCancelled("t2")) || len(r.retryAt) != 0 {
+		t.Errorf("Wrong state: %v", r.state.String())
+	}
+}
+
+func TestRecipe_interrupt(t *testing.T) {
+	name := "interrupt_output.txt"
+	defer os.Remove(name)
+	path, err := TmpRecipe("toml", fmt.Sprintf(`
+main = "t1"
+interp = ['bash', '-c', 'exec {cmd}']
+
+[tasks.t1]
+deps = ["t2", "t3"]
+cmd = "echo t1 >> %[1]s"
+
+[tasks.t2]
+cmd = "sleep 10 && echo t2 >> %[1]s"
+
+[tasks.t3]
+cmd = "echo t3 >> %[1]s"
+`, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Open(path, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	err = r.RunMainContext(ctx, testWorkers())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected an interruption, not %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Running tasks were not terminated: %s", elapsed)
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "t3\n" {
+		t.Errorf("Invalid data: %s", data)
+	}
+
+	/* The state is saved to resume the recipe */
+	state, err := OpenState(path+".state", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(state.IsEnabled("t1") && state.IsCancelled("t2") && state.IsSuccess("t3")) {
+		t.Errorf("Wrong state: %v", state.String())
+	}
+}
+
+func TestRecipe_failureCancelsConditions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "failfast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, err := TmpRecipe("toml", fmt.Sprintf(`
+main = "t1"
+interp = ['bash', '-c', '{cmd}']
+
+[tasks.t1]
+deps = ["a", "b"]
+cmd = "true"
+
+[tasks.a]
+cmd = "sleep 0.2; false"
+
+[tasks.b]
+run_if = "sleep 1"
+cmd = "echo b >> %[1]s/output"
+`, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Open(path, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RunMain(2); err == nil {
+		t.Fatal("Expected failure, not success")
+	}
+	/* b was cancelled while evaluating its condition */
+	time.Sleep(time.Second)
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "output")); err == nil {
+		t.Errorf("Cancelled task was run: %s", data)
+	}
+	state, err := OpenState(path+".state", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := state.Record("b"); !state.IsCancelled("b") || rec.ExitCode != nil {
+		t.Errorf("Wrong state: %v", state.String())
+	}
+}
+
+func TestRecipe_failureWaits(t *testing.T) {
+	path, err := TmpRecipe("toml", `
+main = "t1"
+interp = ['bash', '-c', '{cmd}']
+
+[tasks.t1]
+deps = ["t2", "t3"]
+cmd = "echo t1"
+
+[tasks.t2]
+cmd = "sleep 0.5 && false"
+
+[tasks.t3]
+cmd = "sleep 10"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Open(path, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = r.RunMain(testWorkers())
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Task() != "t2" {
+		t.Fatalf("Expected t2 failure, not %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Running tasks were not terminated: %s", elapsed)
+	}
+	/* Every task has its final state when returning */
+	if !(r.state.IsEnabled("t1") && r.state.IsFailure("t2") && r.state.IsCancelled("t3")) {
+		t.Errorf("Wrong state: %v", r.state.String())
+	}
+}
+
+func TestRecipe_allowedFailureMain(t *testing.T) {
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := NewRecipe(WithMain("t1"), WithLogger(logger), WithMemoryState(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddTask("t1", &Task{Cmd: "false", AllowFailure: Bool(true)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RunMain(testWorkers()); err != nil {
+		t.Errorf("Expected success, not %v", err)
+	}
+}
+
+func TestRecipe_keepGoing(t *testing.T) {
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Parse(strings.NewReader(`
+main = "t"
+interp = ['bash', '-c', '{cmd}']
+
+[tasks.t]
+deps = ["a2", "c", "d"]
+cmd = "true"
+
+[tasks.a]
+cmd = "false"
+
+[tasks.a2]
+deps = ["a"]
+cmd = "true"
+
+[tasks.b]
+cmd = "sleep 0.3"
+
+[tasks.c]
+deps = ["b"]
+cmd = "true"
+
+[tasks.d]
+cmd = "sleep 0.2 && false"
+`), TOML, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetKeepGoing(true)
+	err = r.RunMain(testWorkers())
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("Expected a and d failures, not %v", err)
+	}
+	failed := []string{errs[0].Task(), errs[1].Task()}
+	sort.Strings(failed)
+	if failed[0] != "a" || failed[1] != "d" {
+		t.Errorf("Expected a and d failures, not %v", err)
+	}
+	/* The independent branch is run, and the dependents of the failures blocked */
+	if !(r.state.IsFailure("a") && r.state.IsBlocked("a2") && r.state.IsSuccess("b") &&
+		r.state.IsSuccess("c") && r.state.IsFailure("d") && r.state.IsBlocked("t")) {
+		t.Errorf("Wrong state: %v", r.state.String())
+	}
+}
+
+/*
+Run several main tasks
+*/
+
+func TestRecipe_mainList_TOML(t *testing.T) {
+	testMainList(t, `
+main = ["t1", "t2"]
+interp = ['bash', '-c', 'exec {cmd}']
+
+[tasks.t1]
+cmd = "echo t1 >> %[1]s"
+
+[tasks.t2]
+deps = ["t3"]
+cmd = "echo t2 >> %[1]s"
+
+[tasks.t3]
+cmd = "echo t3 >> %[1]s"
+
+[tasks.t4]
+cmd = "echo t4 >> %[1]s"
+`, "toml")
+}
+
+func TestRecipe_mainList_JSON(t *testing.T) {
+	testMainList(t, `
+{
+	"main": ["t1", "t2"],
+	"interp": ["bash", "-c", "exec {cmd}"],
+	"tasks": {
+		"t1": {"cmd": "echo t1 >> %[1]s"},
+		"t2": {"deps": ["t3"], "cmd": "echo t2 >> %[1]s"},
+		"t3": {"cmd": "echo t3 >> %[1]s"},
+		"t4": {"cmd": "echo t4 >> %[1]s"}
+	}
+}
+`, "json")
+}
+
+func TestRecipe_mainList_YAML(t *testing.T) {
+	testMainList(t, `
+main: [t1, t2]
+interp: [bash, -c, "exec {cmd}"]
+tasks:
+  t1: {cmd: echo t1 >> %[1]s}
+  t2: {deps: [t3], cmd: echo t2 >> %[1]s}
+  t3: {cmd: echo t3 >> %[1]s}
+  t4: {cmd: echo t4 >> %[1]s}
+`, "yaml")
+}
+
+func testMainList(t *testing.T, txt, format string) {
+	name := "main_output.txt"
+	defer os.Remove(name)
+	path, err := TmpRecipe(format, fmt.Sprintf(txt, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Open(path, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RunMain(testWorkers()); err != nil {
+		t.Fatal(err)
+	}
+	if lines := sortedLines(t, name); lines != "t1 t2 t3" {
+		t.Errorf("Invalid data: %s", lines)
+	}
+	os.Remove(name)
+
+	/* Other tasks than the main ones */
+	if err := r.RunTasks([]string{"t4", "t1"}, testWorkers()); err != nil {
+		t.Fatal(err)
+	}
+	if lines := sortedLines(t, name); lines != "t1 t4" {
+		t.Errorf("Invalid data: %s", lines)
+	}
+	if err := r.RunTasks([]string{"t1", "t5"}, testWorkers()); err == nil ||
+		err.Error() != "Unknown referenced main task: t5" {
+		t.Errorf("Expected unknown task, not %v", err)
+	}
+}
+
+func sortedLines(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Fields(string(data))
+	sort.Strings(lines)
+	return strings.Join(lines, " ")
+}
+
+/*
+Validate recipes and report every problem with its position
+*/
+
+func TestRecipe_schema_TOML(t *testing.T) {
+	testSchema(t, `[tasks.a]
+dep = ["b"]
+cmd = ["x"]
+[tasks.b]
+allow_failures = true
+cmd = ""
+`, "toml", []string{
+		"2:1: In tasks.a: Unknown key: dep (did you mean deps?)",
+		"3:1: In tasks.a.cmd: Expected a string, not a list",
+		"5:1: In tasks.b: Unknown key: allow_failures (did you mean allow_failure?)",
+	})
+}
+
+func TestRecipe_schema_JSON(t *testing.T) {
+	testSchema(t, `{"tasks": {
+ "a": {"dep": ["b"],
+  "cmd": ["x"]},
+ "b": {"allow_failures": true, "cmd": ""},
+ "c": null,
+ "d": {"cmd": 3, "deps": ["zz"]}}}
+`, "json", []string{
+		"2:8: In tasks.a: Unknown key: dep (did you mean deps?)",
+		"3:10: In tasks.a.cmd: Expected a string, not a list",
+		"4:8: In tasks.b: Unknown key: allow_failures (did you mean allow_failure?)",
+		"5:7: In tasks.c: Expected a table, not null",
+		"6:15: In tasks.d.cmd: Expected a string, not an integer",
+		/* The rest of the recipe is checked too */
+		"6:2: In task 'd': Unknown referenced task: zz",
+	})
+}
+
+func TestRecipe_schema_YAML(t *testing.T) {
+	testSchema(t, `tasks:
+  a:
+    dep: [b]
+    cmd: [x]
+  b:
+    allow_failures: true
+    cmd: ""
+  c:
+templates:
+  base: null
+`, "yaml", []string{
+		"3:5: In tasks.a: Unknown key: dep (did you mean deps?)",
+		"4:10: In tasks.a.cmd: Expected a string, not a list",
+		"6:5: In tasks.b: Unknown key: allow_failures (did you mean allow_failure?)",
+		"8:5: In tasks.c: Expected a table, not null",
+		"10:9: In templates.base: Expected a table, not null",
+	})
+}
+
+/* The semantic errors are all reported with their positions, even in included recipes */
+func TestRecipe_checkAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recipe.toml")
+	included := filepath.Join(dir, "included.toml")
+	files := map[string]string{
+		path: `main = "missing"
+deadline = "soon"
+include = ["included.toml"]
+
+[tasks.a]
+deps = ["nope"]
+weight = -1
+cmd = "true"
+
+[tasks.b]
+cmd = ""
+`,
+		included: `
+[tasks.c]
+timeout = "never"
+cmd = "true"
+`,
+	}
+	for p, txt := range files {
+		if err := ioutil.WriteFile(p, []byte(txt), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := bytes.Buffer{}
+	logger := NewLogger("[Test] ")
+	logger.l = log.New(&b, "", 0)
+	logger.Level = WarningL
+	err = CheckFile(path, logger)
+	var ds Diagnostics
+	if !errors.As(err, &ds) {
+		t.Fatalf("Expected diagnostics, not %v", err)
+	}
+	expected := []string{
+		path + ":5:1: In task 'a': Negative weight: -1",
+		path + ":5:1: In task 'a': Unknown referenced task: nope",
+		included + ":2:1: In task 'c': Invalid timeout: ",
+		path + ":2:1: Invalid deadline: ",
+		path + ":1:1: Unknown referenced main task: missing",
+	}
+	if len(ds) != len(expected) {
+		t.Fatalf("Expected %d diagnostics, not %d: %v", len(expected), len(ds), err)
+	}
+	for i, d := range ds {
+		if !strings.HasPrefix(d.String(), expected[i]) {
+			t.Errorf("Expected %s, not %s", expected[i], d)
+		}
+	}
+	/* An empty cmd is only a warning */
+	if !strings.Contains(b.String(), path+":11:1: In task 'b': Empty cmd") {
+		t.Errorf("Expected a warning about the empty cmd: %s", b.String())
+	}
+}
+
+func testSchema(t *testing.T, txt, format string, expected []string) {
+	path, err := TmpRecipe(format, txt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	err = CheckFile(path, logger)
+	var ds Diagnostics
+	if !errors.As(err, &ds) {
+		t.Fatalf("Expected diagnostics, not %v", err)
+	}
+	if len(ds) != len(expected) {
+		t.Fatalf("Expected %d diagnostics, not %d: %v", len(expected), len(ds), err)
+	}
+	for i, d := range ds {
+		if d.String() != path+":"+expected[i] {
+			t.Errorf("Expected %s:%s, not %s", path, expected[i], d)
+		}
+	}
+	if _, err := os.Stat(path + ".state"); !os.IsNotExist(err) {
+		t.Errorf("The state file must not be created when checking")
+		os.Remove(path + ".state")
+	}
+}
+
+/*
+Format recipes and convert them to other formats
+*/
+
+const formatTOML = `# Recipe
+interp = ['bash', '-c', 'exec {cmd}']
+main = "t1" # Main task
+
+[tasks.t2]
+cmd = """
+echo t2
+# Not a comment
+"""
+allow_failure = true
+
+# First task
+[tasks.t1]
+env = {B = "2", A = "1"}
+cmd = 'echo "t1"'
+deps = ["t2",]
+`
+
+func TestRecipe_format_TOML(t *testing.T) {
+	testFormat(t, formatTOML, TOML, `# Main task
+main = "t1"
+# Recipe
+interp = ["bash", "-c", "exec {cmd}"]
+
+# First task
+[tasks.t1]
+deps = ["t2"]
+env = {A = "1", B = "2"}
+cmd = 'echo "t1"'
+
+[tasks.t2]
+cmd = '''
+echo t2
+# Not a comment
+'''
+allow_failure = true
+`)
+}
+
+func TestRecipe_format_JSON(t *testing.T) {
+	testFormat(t, formatTOML, JSON, `{
+  // Main task
+  "main": "t1",
+  // Recipe
+  "interp": [
+    "bash",
+    "-c",
+    "exec {cmd}"
+  ],
+  "tasks": {
+    // First task
+    "t1": {
+      "deps": [
+        "t2"
+      ],
+      "env": {
+        "A": "1",
+        "B": "2"
+      },
+      "cmd": "echo \"t1\""
+    },
+    "t2": {
+      "cmd": "echo t2\n# Not a comment\n",
+      "allow_failure": true
+    }
+  }
+}
+`)
+}
+
+func TestRecipe_format_YAML(t *testing.T) {
+	testFormat(t, formatTOML, YAML, `# Main task
+main: t1
+# Recipe
+interp: [bash, -c, 'exec {cmd}']
+tasks:
+  # First task
+  t1:
+    deps: [t2]
+    env:
+      A: "1"
+      B: "2"
+    cmd: echo "t1"
+  t2:
+    cmd: |
+      echo t2
+      # Not a comment
+    allow_failure: true
+`)
+}
+
+/* Formatting would lose the anchors, so they are reported, while converting expands them */
+func TestRecipe_format_YAMLAnchors(t *testing.T) {
+	txt := `env: &env
+  A: "1"
+tasks:
+  t1:
+    <<: {cmd: echo t1}
+    env: *env
+`
+	_, err := FormatRecipe([]byte(txt), YAML)
+	var ds Diagnostics
+	if !errors.As(err, &ds) {
+		t.Fatalf("Expected diagnostics, not %v", err)
+	}
+	expected := []string{
+		"1:6: Anchor &env can not be kept when formatting",
+		"5:5: Merge key can not be kept when formatting",
+		"6:10: Alias *env can not be kept when formatting",
+	}
+	if len(ds) != len(expected) {
+		t.Fatalf("Expected %d diagnostics, not %d: %v", len(expected), len(ds), err)
+	}
+	for i, d := range ds {
+		if d.String() != expected[i] {
+			t.Errorf("Expected %s, not %s", expected[i], d)
+		}
+	}
+	data, err := Convert([]byte(txt), YAML, TOML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `[env]
+A = "1"
+
+[tasks.t1]
+env = {A = "1"}
+cmd = "echo t1"
+`; string(data) != expected {
+		t.Errorf("Invalid TOML recipe:\n%s", data)
+	}
+}
+
+/* Converts the TOML recipe, and checks that the result is already formatted and converts back */
+func testFormat(t *testing.T, txt string, format Format, expected string) {
+	data, err := Convert([]byte(txt), TOML, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != expected {
+		t.Fatalf("Invalid %s recipe:\n%s", format, data)
+	}
+	formatted, err := FormatRecipe(data, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(formatted) != string(data) {
+		t.Errorf("Formatting is not stable:\n%s", formatted)
+	}
+	canonical, err := FormatRecipe([]byte(txt), TOML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := Convert(data, format, TOML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(back) != string(canonical) {
+		t.Errorf("Invalid conversion back to TOML:\n%s", back)
+	}
+}
+
+func TestRecipe_formatExamples(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("examples", "*.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		format := FormatFromPath(path)
+		if format == UnknownFormat {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		formatted, err := FormatRecipe(data, format)
+		if err != nil {
+			t.Errorf("%s: %s", path, err)
+		} else if string(formatted) != string(data) {
+			t.Errorf("%s is not formatted:\n%s", path, formatted)
+		}
+	}
+}
+
 /*
 Test utils
 */
@@ -298,3 +1152,11 @@ func TmpRecipe(format, txt string) (string, error) {
 	}
 	return path, nil
 }
+
+/* Some tests rely on running at least two tasks in parallel */
+func testWorkers() uint {
+	if n := runtime.NumCPU(); n > 2 {
+		return uint(n)
+	}
+	return 2
+}
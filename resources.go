@@ -0,0 +1,80 @@
+package recipe
+
+import (
+	"fmt"
+	"sort"
+)
+
+/*
+ * Resource pools
+ *
+ * A recipe declares the amount of every resource, like the GB of memory or
+ * the database slots, and the tasks declare how much of them they require.
+ * A ready task is only dispatched when there is enough of every resource it
+ * requires, and they are returned to the pools when it ends. Meanwhile, the
+ * tasks that fit in what is left are dispatched.
+ */
+
+type pools map[string]int
+
+func (r *Recipe) checkResources(c *checker) {
+	for _, n := range sortedResources(r.Resources) {
+		if r.Resources[n] < 0 {
+			c.key("resources", fmt.Errorf("Negative amount of resource: %s", n))
+		}
+	}
+	for _, n := range r.taskNames() {
+		t := r.Tasks[n]
+		for _, res := range sortedResources(t.Requires) {
+			amount := t.Requires[res]
+			available, ok := r.Resources[res]
+			switch {
+			case !ok:
+				c.task(n, fmt.Errorf("In task '%s': Unknown resource: %s", n, res))
+			case amount < 0:
+				c.task(n, fmt.Errorf("In task '%s': Negative amount of resource: %s", n, res))
+			case amount > available:
+				c.task(n, fmt.Errorf("In task '%s': Requires %d of resource %s, but there are only %d", n, amount, res, available))
+			}
+		}
+	}
+}
+
+/* Amount of every resource that is not used by the running tasks */
+func (r *Recipe) newPools() pools {
+	p := make(pools, len(r.Resources))
+	for n, amount := range r.Resources {
+		p[n] = amount
+	}
+	return p
+}
+
+func (p pools) fits(t *Task) bool {
+	for n, amount := range t.Requires {
+		if p[n] < amount {
+			return false
+		}
+	}
+	return true
+}
+
+func (p pools) acquire(t *Task) {
+	for n, amount := range t.Requires {
+		p[n] -= amount
+	}
+}
+
+func (p pools) release(t *Task) {
+	for n, amount := range t.Requires {
+		p[n] += amount
+	}
+}
+
+func sortedResources(resources map[string]int) []string {
+	names := make([]string, 0, len(resources))
+	for n := range resources {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,98 @@
+package recipe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+/* The running tasks never require more than the available resources */
+func TestRecipe_resources(t *testing.T) {
+	txt := `
+main = "t"
+interp = ['bash', '-c', '{cmd}']
+
+[resources]
+db = 1
+mem_gb = 32
+
+[tasks.t]
+deps = ["t1", "t2", "t3"]
+
+[tasks.t1]
+requires = {db = 1, mem_gb = 8}
+cmd = "echo start >> %[1]s; sleep 0.2; echo end >> %[1]s"
+
+[tasks.t2]
+requires = {db = 1}
+cmd = "echo start >> %[1]s; sleep 0.2; echo end >> %[1]s"
+
+[tasks.t3]
+requires = {mem_gb = 8}
+cmd = "sleep 0.1"
+`
+	name := "resources_output.txt"
+	defer os.Remove(name)
+	path, err := TmpRecipe("toml", fmt.Sprintf(txt, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Open(path, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RunMain(testWorkers()); err != nil {
+		t.Fatal(err)
+	}
+	/* There is only one database, so t1 and t2 never overlap */
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Join(strings.Fields(string(data)), " "); lines != "start end start end" {
+		t.Errorf("Invalid data: %s", lines)
+	}
+}
+
+func TestRecipe_resourcesCheck(t *testing.T) {
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	for txt, expected := range map[string]string{
+		`
+[resources]
+db = 2
+
+[tasks.t1]
+requires = {db = 3}
+cmd = "true"
+`: "5:1: In task 't1': Requires 3 of resource db, but there are only 2",
+		`
+[resources]
+db = 2
+
+[tasks.t1]
+requires = {mem_gb = 1}
+cmd = "true"
+`: "5:1: In task 't1': Unknown resource: mem_gb",
+		`
+[resources]
+db = -1
+
+[tasks.t1]
+cmd = "true"
+`: "2:1: Negative amount of resource: db",
+	} {
+		_, err := Parse(strings.NewReader(txt), TOML, logger, logger)
+		if err == nil || err.Error() != expected {
+			t.Errorf("Expected %q, not %v", expected, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package recipe
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"time"
+)
+
+/*
+ * Retries
+ *
+ * A failed task with retries is enabled again instead of failing the run,
+ * until it has been attempted retries + 1 times. It is dispatched again
+ * after retry_delay, multiplied by retry_backoff after each attempt. With
+ * retry_on_exit_codes only those exit codes are retried.
+ */
+
+func (t *Task) checkRetries() error {
+	if t.Retries < 0 {
+		return fmt.Errorf("In task '%s': Negative retries: %d", t.name, t.Retries)
+	}
+	if _, err := parseDuration(t.RetryDelay); err != nil {
+		return fmt.Errorf("In task '%s': Invalid retry_delay: %s", t.name, err.Error())
+	}
+	if t.RetryBackoff != 0 && t.RetryBackoff < 1 {
+		return fmt.Errorf("In task '%s': The retry_backoff must be at least 1, not %g", t.name, t.RetryBackoff)
+	}
+	return nil
+}
+
+/* Whether the error of the given attempt can be retried */
+func (t *Task) retryable(attempt int, err error) bool {
+	if attempt > t.Retries {
+		return false
+	}
+	if len(t.RetryOnExitCodes) == 0 {
+		return true
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	for _, code := range t.RetryOnExitCodes {
+		if exitErr.ExitCode() == code {
+			return true
+		}
+	}
+	return false
+}
+
+/* Time to wait before retrying the given attempt */
+func (t *Task) retryDelay(attempt int) time.Duration {
+	delay, _ := parseDuration(t.RetryDelay)
+	if t.RetryBackoff > 1 {
+		delay = time.Duration(float64(delay) * math.Pow(t.RetryBackoff, float64(attempt-1)))
+	}
+	return delay
+}
+
+/* Enables the failed task again if it has retries left */
+func (r *Recipe) retry(result *result) bool {
+	t := r.Tasks[result.n]
+	attempt := r.state.Attempt(result.n)
+	if !t.retryable(attempt, result.e) {
+		return false
+	}
+	delay := t.retryDelay(attempt)
+	r.logger.Warning("Retrying '%s' in %s (attempt %d of %d): %s", result.n, delay, attempt+1, t.Retries+1, result.e.Error())
+	r.state.MustSetRetrying(result.n)
+	r.retryAt[result.n] = time.Now().Add(delay)
+	return true
+}
+
+/* Time until the next retry that is not due yet */
+func (r *Recipe) nextRetry() (time.Duration, bool) {
+	now := time.Now()
+	next := time.Duration(math.MaxInt64)
+	found := false
+	for _, at := range r.retryAt {
+		if d := at.Sub(now); d > 0 && d < next {
+			next = d
+			found = true
+		}
+	}
+	return next, found
+}
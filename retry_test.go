@@ -0,0 +1,107 @@
+package recipe
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+/* The failed tasks are retried, after a delay that grows with each attempt */
+func TestRecipe_retries(t *testing.T) {
+	txt := `
+main = "t"
+interp = ['bash', '-c', '{cmd}']
+
+[tasks.t]
+deps = ["t1", "t2"]
+
+[tasks.t1]
+retries = 3
+retry_delay = "50ms"
+retry_backoff = 2
+cmd = "echo t1 >> %[1]s; [ $(grep -c t1 %[1]s) -ge 3 ]"
+
+[tasks.t2]
+retries = 1
+retry_on_exit_codes = [3]
+cmd = "echo t2 >> %[1]s; [ $(grep -c t2 %[1]s) -ge 2 ] || exit 3"
+`
+	name := "retries_output.txt"
+	defer os.Remove(name)
+	path, err := TmpRecipe("toml", fmt.Sprintf(txt, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Open(path, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := r.RunMain(testWorkers()); err != nil {
+		t.Fatal(err)
+	}
+	/* Waits 50ms and then 100ms */
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("The retries were not delayed: %s", elapsed)
+	}
+	if lines := sortedLines(t, name); lines != "t1 t1 t1 t2 t2" {
+		t.Errorf("Invalid data: %s", lines)
+	}
+	if r.state.Attempt("t1") != 3 || r.state.Attempt("t2") != 2 {
+		t.Errorf("Wrong attempts: %v", r.state.String())
+	}
+}
+
+func TestRecipe_retriesExhausted(t *testing.T) {
+	path, err := TmpRecipe("toml", `
+main = "t"
+interp = ['bash', '-c', '{cmd}']
+
+[tasks.t]
+deps = ["t1", "t2"]
+
+[tasks.t1]
+retries = 2
+cmd = "false"
+
+[tasks.t2]
+retries = 2
+retry_on_exit_codes = [3]
+cmd = "sleep 0.2; exit 4"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Open(path, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetKeepGoing(true)
+	err = r.RunMain(testWorkers())
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("Expected t1 and t2 failures, not %v", err)
+	}
+	/* The attempts are saved in the state file */
+	state, err := OpenState(path+".state", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Attempt("t1") != 3 || state.Attempt("t2") != 1 {
+		t.Errorf("Wrong attempts: %v", state.String())
+	}
+}
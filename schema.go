@@ -0,0 +1,754 @@
+package recipe
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/DisposaBoy/JsonConfigReader"
+	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+ * Schema validation
+ *
+ * Before decoding a recipe, its document is converted to a tree of nodes
+ * that keeps the position of every key and value. That tree is compared
+ * with the fields of Recipe and Task to report every unknown key and wrong
+ * type at once, instead of silently ignoring them.
+ */
+
+/*
+ * Diagnostics
+ */
+
+type Diagnostic struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+	Err    error // Error reported by the semantic checks, if any
+}
+
+func (d Diagnostic) String() string {
+	var b strings.Builder
+	if d.File != "" {
+		b.WriteString(d.File)
+		b.WriteString(":")
+	}
+	if d.Line > 0 {
+		fmt.Fprintf(&b, "%d:", d.Line)
+		if d.Column > 0 {
+			fmt.Fprintf(&b, "%d:", d.Column)
+		}
+	}
+	if b.Len() > 0 {
+		b.WriteString(" ")
+	}
+	b.WriteString(d.Msg)
+	return b.String()
+}
+
+type Diagnostics []Diagnostic
+
+func (ds Diagnostics) Error() string {
+	lines := make([]string, len(ds))
+	for i, d := range ds {
+		lines[i] = d.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (ds Diagnostics) Unwrap() []error {
+	errs := []error{}
+	for _, d := range ds {
+		if d.Err != nil {
+			errs = append(errs, d.Err)
+		}
+	}
+	return errs
+}
+
+/* Adds the diagnostics of err, or err itself, to the ones of the recipe */
+func (ds Diagnostics) join(err error) error {
+	if len(ds) == 0 {
+		return err
+	}
+	if err != nil {
+		var other Diagnostics
+		if errors.As(err, &other) {
+			ds = append(ds, other...)
+		} else {
+			ds = append(ds, Diagnostic{Msg: err.Error(), Err: err})
+		}
+	}
+	return ds
+}
+
+// withFile sets the file of the diagnostics in err, or adds it to the
+// message of any other error.
+func withFile(file string, err error) error {
+	var ds Diagnostics
+	if errors.As(err, &ds) {
+		ds.setFile(file)
+		return err
+	}
+	return fmt.Errorf("(%s) %w", file, err)
+}
+
+func (ds Diagnostics) setFile(file string) {
+	for i := range ds {
+		if ds[i].File == "" {
+			ds[i].File = file
+		}
+	}
+}
+
+func (ds Diagnostics) sort() {
+	sort.SliceStable(ds, func(i, j int) bool {
+		if ds[i].Line != ds[j].Line {
+			return ds[i].Line < ds[j].Line
+		}
+		return ds[i].Column < ds[j].Column
+	})
+}
+
+/*
+ * Positions
+ *
+ * The semantic checks run once the recipe is decoded, so the positions of
+ * its keys and tasks are kept to report their errors like the syntax ones.
+ */
+
+type position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (p position) diagnostic(err error) Diagnostic {
+	return Diagnostic{File: p.File, Line: p.Line, Column: p.Column, Msg: err.Error(), Err: err}
+}
+
+func nodePosition(n *node) position {
+	return position{Line: n.line, Column: n.col}
+}
+
+/* Keeps the positions of the keys of the recipe, and of its tasks and templates */
+func (r *Recipe) setPositions(n *node) {
+	if n.kind != mapNode {
+		return
+	}
+	r.positions = make(map[string]position, len(n.keys))
+	for i, k := range n.keys {
+		key := k.value.(string)
+		r.positions[key] = nodePosition(k)
+		var tasks map[string]*Task
+		switch key {
+		case "tasks":
+			tasks = r.Tasks
+		case "templates":
+			tasks = r.Templates
+		}
+		if item := n.items[i]; tasks != nil && item.kind == mapNode {
+			for j, name := range item.keys {
+				t, ok := tasks[name.value.(string)]
+				if !ok || t == nil {
+					continue
+				}
+				t.pos = nodePosition(name)
+				for k, field := range item.items[j].keys {
+					if field.value == "cmd" && !item.items[j].items[k].invalid {
+						t.cmdPos = nodePosition(field)
+					}
+				}
+			}
+		}
+	}
+}
+
+/* Sets the file of the positions that do not have one yet */
+func (r *Recipe) setPositionsFile(file string) {
+	for k, p := range r.positions {
+		if p.File == "" {
+			p.File = file
+			r.positions[k] = p
+		}
+	}
+	for _, tasks := range []map[string]*Task{r.Tasks, r.Templates} {
+		for _, t := range tasks {
+			if t != nil && t.pos.File == "" {
+				t.pos.File = file
+			}
+			if t != nil && t.cmdPos.File == "" && t.cmdPos.Line > 0 {
+				t.cmdPos.File = file
+			}
+		}
+	}
+}
+
+/*
+ * Nodes
+ */
+
+type nodeKind int
+
+const (
+	nullNode nodeKind = iota
+	scalarNode
+	listNode
+	mapNode
+)
+
+type node struct {
+	kind     nodeKind
+	value    interface{} // string, bool, int64 or float64 in scalar nodes
+	keys     []*node     // Keys of map nodes, with items as their values
+	items    []*node
+	line     int
+	col      int
+	comments []string // Comments placed before a key
+	trailing []string // Comments at the end of the document
+	table    bool     // Map written as a table section in TOML
+	invalid  bool     // Reported by the validation, so it is not decoded
+}
+
+/* The value of the node, without the invalid ones, as decoded by encoding/json */
+func (n *node) plain() interface{} {
+	switch n.kind {
+	case listNode:
+		items := []interface{}{}
+		for _, item := range n.items {
+			if !item.invalid {
+				items = append(items, item.plain())
+			}
+		}
+		return items
+	case mapNode:
+		m := make(map[string]interface{}, len(n.keys))
+		for i, k := range n.keys {
+			if !n.items[i].invalid {
+				m[k.value.(string)] = n.items[i].plain()
+			}
+		}
+		return m
+	}
+	return n.value
+}
+
+func (n *node) describe() string {
+	switch n.kind {
+	case nullNode:
+		return "null"
+	case listNode:
+		return "a list"
+	case mapNode:
+		return "a table"
+	}
+	switch n.value.(type) {
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case int64:
+		return "an integer"
+	case float64:
+		return "a float"
+	}
+	return fmt.Sprintf("%T", n.value)
+}
+
+func parseNode(data []byte, format Format) (*node, error) {
+	switch format {
+	case JSON:
+		return parseJSONNode(data)
+	case TOML:
+		return parseTOMLNode(data)
+	case YAML:
+		return parseYAMLNode(data)
+	}
+	return nil, errUnknownFormat
+}
+
+/* JSON */
+
+type jsonNodeParser struct {
+	data []byte // Without comments, to skip the separators
+	orig []byte // With comments, to count the lines
+	dec  *json.Decoder
+}
+
+func parseJSONNode(data []byte) (*node, error) {
+	/* Comments and trailing commas are replaced by spaces, so offsets are kept */
+	clean, err := ioutil.ReadAll(JsonConfigReader.New(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	p := &jsonNodeParser{clean, data, json.NewDecoder(bytes.NewReader(clean))}
+	p.dec.UseNumber()
+	n, err := p.parse()
+	if err != nil {
+		if e, ok := err.(*json.SyntaxError); ok {
+			line, col := offsetPosition(data, int(e.Offset))
+			return nil, Diagnostics{{Line: line, Column: col, Msg: e.Error()}}
+		}
+		return nil, Diagnostics{{Msg: err.Error()}}
+	}
+	return n, nil
+}
+
+/* Offset of the next token, skipping the separators consumed by the decoder */
+func (p *jsonNodeParser) offset() int {
+	off := int(p.dec.InputOffset())
+	for off < len(p.data) {
+		switch p.data[off] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			off++
+			continue
+		}
+		break
+	}
+	return off
+}
+
+func (p *jsonNodeParser) parse() (*node, error) {
+	off := p.offset()
+	tok, err := p.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	n := &node{}
+	n.line, n.col = offsetPosition(p.orig, off)
+	switch v := tok.(type) {
+	case json.Delim:
+		if v == '{' {
+			n.kind = mapNode
+			for p.dec.More() {
+				koff := p.offset()
+				ktok, err := p.dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				k := &node{kind: scalarNode, value: ktok}
+				k.line, k.col = offsetPosition(p.orig, koff)
+				item, err := p.parse()
+				if err != nil {
+					return nil, err
+				}
+				n.keys = append(n.keys, k)
+				n.items = append(n.items, item)
+			}
+		} else {
+			n.kind = listNode
+			for p.dec.More() {
+				item, err := p.parse()
+				if err != nil {
+					return nil, err
+				}
+				n.items = append(n.items, item)
+			}
+		}
+		/* Closing delimiter */
+		if _, err := p.dec.Token(); err != nil {
+			return nil, err
+		}
+	case json.Number:
+		n.kind = scalarNode
+		if i, err := v.Int64(); err == nil {
+			n.value = i
+		} else if f, err := v.Float64(); err == nil {
+			n.value = f
+		} else {
+			return nil, err
+		}
+	case nil:
+		n.kind = nullNode
+	default:
+		n.kind = scalarNode
+		n.value = v
+	}
+	return n, nil
+}
+
+func offsetPosition(data []byte, offset int) (int, int) {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	line := 1 + bytes.Count(data[:offset], []byte("\n"))
+	col := offset - bytes.LastIndexByte(data[:offset], '\n')
+	return line, col
+}
+
+/* TOML */
+
+var tomlErrorRegexp = regexp.MustCompile(`^\((\d+), (\d+)\): (.*)$`)
+
+func parseTOMLNode(data []byte) (*node, error) {
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		if m := tomlErrorRegexp.FindStringSubmatch(err.Error()); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			col, _ := strconv.Atoi(m[2])
+			return nil, Diagnostics{{Line: line, Column: col, Msg: m[3]}}
+		}
+		return nil, Diagnostics{{Msg: err.Error()}}
+	}
+	return tomlTreeNode(tree), nil
+}
+
+func tomlTreeNode(tree *toml.Tree) *node {
+	pos := tree.Position()
+	n := &node{kind: mapNode, line: pos.Line, col: pos.Col}
+	keys := tree.Keys()
+	positions := make(map[string]toml.Position, len(keys))
+	for _, k := range keys {
+		positions[k] = tree.GetPositionPath([]string{k})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		pi, pj := positions[keys[i]], positions[keys[j]]
+		if pi.Line != pj.Line {
+			return pi.Line < pj.Line
+		}
+		return pi.Col < pj.Col
+	})
+	for _, k := range keys {
+		pos := positions[k]
+		n.keys = append(n.keys, &node{kind: scalarNode, value: k, line: pos.Line, col: pos.Col})
+		n.items = append(n.items, tomlValueNode(tree.GetPath([]string{k}), pos))
+	}
+	return n
+}
+
+/* Values have the position of their keys, but tables have their own one */
+func tomlValueNode(v interface{}, pos toml.Position) *node {
+	switch v := v.(type) {
+	case *toml.Tree:
+		return tomlTreeNode(v)
+	case []*toml.Tree:
+		n := &node{kind: listNode, line: pos.Line, col: pos.Col}
+		for _, t := range v {
+			n.items = append(n.items, tomlTreeNode(t))
+		}
+		return n
+	case []interface{}:
+		n := &node{kind: listNode, line: pos.Line, col: pos.Col}
+		for _, item := range v {
+			n.items = append(n.items, tomlValueNode(item, pos))
+		}
+		return n
+	case uint64:
+		return &node{kind: scalarNode, value: int64(v), line: pos.Line, col: pos.Col}
+	case nil:
+		return &node{kind: nullNode, line: pos.Line, col: pos.Col}
+	case string, bool, int64, float64:
+		return &node{kind: scalarNode, value: v, line: pos.Line, col: pos.Col}
+	}
+	/* Dates and times */
+	return &node{kind: scalarNode, value: fmt.Sprint(v), line: pos.Line, col: pos.Col}
+}
+
+/* YAML */
+
+var yamlErrorRegexp = regexp.MustCompile(`line (\d+): (.*)$`)
+
+func parseYAMLNode(data []byte) (*node, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		ds := Diagnostics{}
+		for _, l := range strings.Split(strings.TrimPrefix(err.Error(), "yaml: "), "\n") {
+			l = strings.TrimSpace(l)
+			if m := yamlErrorRegexp.FindStringSubmatch(l); m != nil {
+				line, _ := strconv.Atoi(m[1])
+				ds = append(ds, Diagnostic{Line: line, Msg: m[2]})
+			} else if l != "" && !strings.HasSuffix(l, ":") {
+				ds = append(ds, Diagnostic{Msg: l})
+			}
+		}
+		return nil, ds
+	}
+	if doc.Kind == 0 || len(doc.Content) == 0 {
+		return &node{kind: nullNode}, nil
+	}
+	return yamlValueNode(doc.Content[0], 0)
+}
+
+/* Limit the expansion of aliases, as they can be nested to build huge documents */
+const maxYAMLAliasDepth = 32
+
+func yamlValueNode(y *yaml.Node, aliases int) (*node, error) {
+	n := &node{line: y.Line, col: y.Column}
+	switch y.Kind {
+	case yaml.AliasNode:
+		if aliases >= maxYAMLAliasDepth {
+			return nil, Diagnostics{{Line: y.Line, Column: y.Column, Msg: "Too many nested aliases"}}
+		}
+		return yamlValueNode(y.Alias, aliases+1)
+	case yaml.MappingNode:
+		n.kind = mapNode
+		seen := make(map[string]bool)
+		merged := make([]*yaml.Node, 0)
+		for i := 0; i+1 < len(y.Content); i += 2 {
+			k, v := y.Content[i], y.Content[i+1]
+			if k.Tag == "!!merge" {
+				merged = append(merged, v)
+				continue
+			}
+			if err := n.addYAMLPair(k, v, aliases); err != nil {
+				return nil, err
+			}
+			seen[k.Value] = true
+		}
+		/* Merged keys never override the explicit ones */
+		for _, m := range merged {
+			sources := []*yaml.Node{m}
+			if m.Kind == yaml.SequenceNode {
+				sources = m.Content
+			}
+			for _, s := range sources {
+				mn, err := yamlValueNode(s, aliases)
+				if err != nil {
+					return nil, err
+				}
+				if mn.kind != mapNode {
+					return nil, Diagnostics{{Line: s.Line, Column: s.Column, Msg: "Only tables can be merged"}}
+				}
+				for i, k := range mn.keys {
+					if name := k.value.(string); !seen[name] {
+						seen[name] = true
+						n.keys = append(n.keys, k)
+						n.items = append(n.items, mn.items[i])
+					}
+				}
+			}
+		}
+	case yaml.SequenceNode:
+		n.kind = listNode
+		for _, c := range y.Content {
+			item, err := yamlValueNode(c, aliases)
+			if err != nil {
+				return nil, err
+			}
+			n.items = append(n.items, item)
+		}
+	case yaml.ScalarNode:
+		n.kind = scalarNode
+		var err error
+		switch y.ShortTag() {
+		case "!!null":
+			n.kind = nullNode
+		case "!!bool":
+			var b bool
+			err = y.Decode(&b)
+			n.value = b
+		case "!!int":
+			var i int64
+			err = y.Decode(&i)
+			n.value = i
+		case "!!float":
+			var f float64
+			err = y.Decode(&f)
+			n.value = f
+		default:
+			n.value = y.Value
+		}
+		if err != nil {
+			return nil, Diagnostics{{Line: y.Line, Column: y.Column, Msg: err.Error()}}
+		}
+	}
+	return n, nil
+}
+
+func (n *node) addYAMLPair(k, v *yaml.Node, aliases int) error {
+	if k.Kind != yaml.ScalarNode {
+		return Diagnostics{{Line: k.Line, Column: k.Column, Msg: "Keys must be strings"}}
+	}
+	item, err := yamlValueNode(v, aliases)
+	if err != nil {
+		return err
+	}
+	n.keys = append(n.keys, &node{kind: scalarNode, value: k.Value, line: k.Line, col: k.Column})
+	n.items = append(n.items, item)
+	return nil
+}
+
+/*
+ * Validation
+ */
+
+var (
+	taskType    = reflect.TypeOf(Task{})
+	targetsType = reflect.TypeOf(Targets{})
+)
+
+func validateNode(n *node, t reflect.Type) Diagnostics {
+	ds := Diagnostics{}
+	validateValue(n, t, "", &ds)
+	ds.sort()
+	return ds
+}
+
+func validateValue(n *node, t reflect.Type, path string, ds *Diagnostics) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if n.kind == nullNode {
+		return
+	}
+	wrongType := func(expected string) {
+		n.invalid = true
+		*ds = append(*ds, Diagnostic{Line: n.line, Column: n.col,
+			Msg: fmt.Sprintf("%s: Expected %s, not %s", displayPath(path), expected, n.describe())})
+	}
+	if t == targetsType && n.kind != listNode {
+		if _, ok := n.value.(string); !ok || n.kind != scalarNode {
+			wrongType("a string or a list")
+		}
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.kind != mapNode {
+			wrongType("a table")
+			return
+		}
+		fields := schemaFields(t)
+		for i, k := range n.keys {
+			name := k.value.(string)
+			f, ok := fields[name]
+			if !ok {
+				msg := fmt.Sprintf("%s: Unknown key: %s", displayPath(path), name)
+				if s := suggestKey(name, fields); s != "" {
+					msg += fmt.Sprintf(" (did you mean %s?)", s)
+				}
+				*ds = append(*ds, Diagnostic{Line: k.line, Column: k.col, Msg: msg})
+				n.items[i].invalid = true
+				continue
+			}
+			item := n.items[i]
+			validateValue(item, f.Type, joinPath(path, name), ds)
+		}
+	case reflect.Map:
+		if n.kind != mapNode {
+			wrongType("a table")
+			return
+		}
+		for i, k := range n.keys {
+			item := n.items[i]
+			/* A null would be decoded as a nil task */
+			if item.kind == nullNode && t.Elem() == reflect.PtrTo(taskType) {
+				item.invalid = true
+				*ds = append(*ds, Diagnostic{Line: item.line, Column: item.col,
+					Msg: fmt.Sprintf("%s: Expected a table, not null", displayPath(joinPath(path, k.value.(string))))})
+				continue
+			}
+			validateValue(item, t.Elem(), joinPath(path, k.value.(string)), ds)
+		}
+	case reflect.Slice:
+		if n.kind != listNode {
+			wrongType("a list")
+			return
+		}
+		for i, item := range n.items {
+			validateValue(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), ds)
+		}
+	case reflect.String:
+		if _, ok := n.value.(string); !ok || n.kind != scalarNode {
+			wrongType("a string")
+		}
+	case reflect.Bool:
+		if _, ok := n.value.(bool); !ok || n.kind != scalarNode {
+			wrongType("a boolean")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if _, ok := n.value.(int64); !ok || n.kind != scalarNode {
+			wrongType("an integer")
+		}
+	case reflect.Float32, reflect.Float64:
+		switch n.value.(type) {
+		case int64, float64:
+		default:
+			wrongType("a number")
+		}
+	}
+}
+
+/* Fields of a struct by their name in the recipes */
+func schemaFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+func suggestKey(name string, fields map[string]reflect.StructField) string {
+	best, bestDistance := "", 3
+	for f := range fields {
+		if d := editDistance(name, f); d < bestDistance || (d == bestDistance && f < best) {
+			best, bestDistance = f, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "Recipe"
+	}
+	return "In " + path
+}
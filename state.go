@@ -6,9 +6,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/DisposaBoy/JsonConfigReader"
 )
@@ -28,39 +31,91 @@ const (
 	Cancelled
 	Success
 	Failure
+	Blocked
+	TimedOut
+	Skipped
 )
 
+/*
+ * Version of the state files. The first ones had no version, and only kept
+ * the states and the attempts of the tasks.
+ */
+const StateVersion = 2
+
 type State struct {
-	States map[string]TaskState `json:"states" toml:"states"`
-	path   string
-	logger *Logger
-	mu     sync.RWMutex
+	Version int                    `json:"version" toml:"version"`
+	States  map[string]TaskState   `json:"states" toml:"states"`
+	Records map[string]*TaskRecord `json:"records" toml:"records"`
+	path    string
+	logger  *Logger
+	mu      sync.RWMutex
+}
+
+// NewState creates an empty state that is only kept in memory.
+func NewState(logger *Logger) *State {
+	return &State{
+		Version: StateVersion,
+		States:  make(map[string]TaskState),
+		Records: make(map[string]*TaskRecord),
+		logger:  logger,
+	}
 }
 
 func OpenState(path string, logger *Logger) (*State, error) {
-	var s State
+	s := NewState(logger)
 
 	/* Try to open file */
 	f, err := os.Open(path)
 	if err != nil {
-		/* If is not possible, create and empty struct */
-		s = State{
-			States: make(map[string]TaskState),
-		}
+		/* If is not possible, keep the empty state */
 		logger.Info("Creating state file: %s", path)
 	} else {
-		err = json.NewDecoder(JsonConfigReader.New(f)).Decode(&s)
+		defer f.Close()
+		err = s.decode(JsonConfigReader.New(f))
 		if err != nil {
 			return nil, fmt.Errorf("(%s) %s", path, err.Error())
 		}
 		logger.Info("Loading state file: %s", path)
 	}
 	s.path = path
-	s.logger = logger
-	return &s, nil
+	return s, nil
+}
+
+/* Decodes a state file, migrating it if it has an older version */
+func (s *State) decode(rd io.Reader) error {
+	var file struct {
+		State
+		Attempts map[string]int `json:"attempts"`
+	}
+	if err := json.NewDecoder(rd).Decode(&file); err != nil {
+		return err
+	}
+	if file.Version == 0 {
+		/* The files without version */
+		file.Version = 1
+	}
+	if file.Version > StateVersion {
+		return fmt.Errorf("Unsupported state version: %d", file.Version)
+	}
+	if file.States != nil {
+		s.States = file.States
+	}
+	if file.Records != nil {
+		s.Records = file.Records
+	}
+	if file.Version < StateVersion {
+		s.logger.Info("Migrating state from version %d to %d", file.Version, StateVersion)
+		for n, attempt := range file.Attempts {
+			s.Records[n] = &TaskRecord{Attempt: attempt}
+		}
+	}
+	return nil
 }
 
 func (s *State) Save() error {
+	if s.path == "" {
+		return nil
+	}
 	b := s.serialize(true)
 	err := ioutil.WriteFile(s.path, b.Bytes(), 0644)
 	if err != nil {
@@ -71,6 +126,9 @@ func (s *State) Save() error {
 }
 
 func (s *State) Remove() error {
+	if s.path == "" {
+		return nil
+	}
 	err := os.Remove(s.path)
 	if err != nil {
 		return err
@@ -79,6 +137,14 @@ func (s *State) Remove() error {
 	return nil
 }
 
+/* Forgets the states of every task */
+func (s *State) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.States = make(map[string]TaskState)
+	s.Records = make(map[string]*TaskRecord)
+}
+
 func (s *State) String() string {
 	return s.serialize(false).String()
 }
@@ -106,6 +172,7 @@ func (s *State) SetDisabled(taskName string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.States[taskName] = Disabled
+	delete(s.Records, taskName)
 }
 
 func (s *State) SetEnabled(taskName string) error {
@@ -153,6 +220,28 @@ func (s *State) MustSetRunning(taskName string) {
 		panic(fmt.Errorf("Current state must be Waiting, not %s", s.States[taskName].String()))
 	}
 	s.States[taskName] = Running
+	s.start(taskName)
+}
+
+/* Failed tasks that will be run again */
+func (s *State) MustSetRetrying(taskName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.States[taskName] != Running {
+		panic(fmt.Errorf("Current state must be Running, not %s", s.States[taskName].String()))
+	}
+	s.States[taskName] = Enabled
+}
+
+// Attempt returns how many times the task has been started in the current
+// run.
+func (s *State) Attempt(taskName string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if rec, ok := s.Records[taskName]; ok {
+		return rec.Attempt
+	}
+	return 0
 }
 
 func (s *State) IsRunning(taskName string) bool {
@@ -206,8 +295,163 @@ func (s *State) IsFailure(taskName string) bool {
 	return s.States[taskName] == Failure
 }
 
+/* Failed tasks that were terminated when reaching a timeout or the deadline */
+func (s *State) MustSetTimedOut(taskName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.States[taskName] != Running {
+		panic(fmt.Errorf("Current state must be Running, not %s", s.States[taskName].String()))
+	}
+	s.States[taskName] = TimedOut
+}
+
+func (s *State) IsTimedOut(taskName string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.States[taskName] == TimedOut
+}
+
+/* Tasks whose conditions were not met, which satisfy their dependents */
+func (s *State) MustSetSkipped(taskName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.States[taskName] != Running {
+		panic(fmt.Errorf("Current state must be Running, not %s", s.States[taskName].String()))
+	}
+	s.States[taskName] = Skipped
+}
+
+func (s *State) IsSkipped(taskName string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.States[taskName] == Skipped
+}
+
+/* Tasks that depend on a failed one, when the rest of the recipe keeps going */
+func (s *State) MustSetBlocked(taskName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.States[taskName] != Enabled {
+		panic(fmt.Errorf("Current state must be Enabled, not %s", s.States[taskName].String()))
+	}
+	s.States[taskName] = Blocked
+}
+
+func (s *State) IsBlocked(taskName string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.States[taskName] == Blocked
+}
+
+// IsPending tells whether the task is part of the current run, but it has
+// not ended yet.
+func (s *State) IsPending(taskName string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	switch s.States[taskName] {
+	case Enabled, Waiting, Running:
+		return true
+	}
+	return false
+}
+
+// IsSatisfied tells whether the dependents of the task can run.
+func (s *State) IsSatisfied(taskName string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.States[taskName] == Success || s.States[taskName] == Skipped
+}
+
 func (s *State) IsDone(taskName string) bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	return s.States[taskName] == Failure || s.States[taskName] == Success
 }
+
+/***
+ * Records
+ */
+
+// TaskRecord keeps how the last attempt of a task ran. Command is the
+// fingerprint of its resolved command, and Duration is in seconds. The exit
+// code and the signal are only known for the commands that were started.
+type TaskRecord struct {
+	Attempt  int        `json:"attempt"`
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	Duration float64    `json:"duration,omitempty"`
+	ExitCode *int       `json:"exit_code,omitempty"`
+	Signal   string     `json:"signal,omitempty"`
+	Host     string     `json:"host,omitempty"`
+	Command  string     `json:"command,omitempty"`
+}
+
+var hostname = func() string {
+	h, _ := os.Hostname()
+	return h
+}()
+
+/* Starts a new attempt, forgetting how the previous one ended */
+func (s *State) start(taskName string) {
+	attempt := 0
+	if rec, ok := s.Records[taskName]; ok {
+		attempt = rec.Attempt
+	}
+	now := time.Now()
+	s.Records[taskName] = &TaskRecord{
+		Attempt: attempt + 1,
+		Start:   &now,
+		Host:    hostname,
+	}
+}
+
+/* The record of the current attempt, created if the task was not started by a run */
+func (s *State) record(taskName string) *TaskRecord {
+	rec, ok := s.Records[taskName]
+	if !ok {
+		rec = &TaskRecord{}
+		s.Records[taskName] = rec
+	}
+	return rec
+}
+
+// Record returns a copy of the record of the task, if it has one.
+func (s *State) Record(taskName string) (TaskRecord, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rec, ok := s.Records[taskName]
+	if !ok {
+		return TaskRecord{}, false
+	}
+	return *rec, true
+}
+
+func (s *State) setCommand(taskName, fingerprint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record(taskName).Command = fingerprint
+}
+
+/* Records how the process of the task exited */
+func (s *State) setExited(taskName string, ps *os.ProcessState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := s.record(taskName)
+	if status, ok := ps.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		rec.Signal = status.Signal().String()
+		return
+	}
+	code := ps.ExitCode()
+	rec.ExitCode = &code
+}
+
+func (s *State) setEnded(taskName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := s.record(taskName)
+	now := time.Now()
+	rec.End = &now
+	if rec.Start != nil {
+		rec.Duration = now.Sub(*rec.Start).Seconds()
+	}
+}
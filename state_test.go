@@ -0,0 +1,129 @@
+package recipe
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecipe_records(t *testing.T) {
+	path, err := TmpRecipe("toml", `
+main = "t1"
+interp = ['bash', '-c', '{cmd}']
+
+[tasks.t1]
+deps = ["t2", "t3", "t4"]
+cmd = "true"
+
+[tasks.t2]
+cmd = "exit 3"
+
+[tasks.t3]
+cmd = "sleep 0.1"
+
+[tasks.t4]
+cmd = "kill -TERM $$"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Open(path, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetKeepGoing(true)
+	start := time.Now()
+	if err := r.RunMain(testWorkers()); err == nil {
+		t.Fatal("Expected failure, not success")
+	}
+
+	state, err := OpenState(path+".state", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != StateVersion {
+		t.Errorf("Wrong version: %d", state.Version)
+	}
+	host, _ := os.Hostname()
+	for _, n := range []string{"t2", "t3", "t4"} {
+		rec, ok := state.Record(n)
+		if !ok {
+			t.Fatalf("No record of %s", n)
+		}
+		if rec.Attempt != 1 || rec.Host != host || len(rec.Command) != 64 {
+			t.Errorf("Wrong record of %s: %+v", n, rec)
+		}
+		if rec.Start == nil || rec.End == nil || rec.Start.Before(start) || rec.End.Before(*rec.Start) {
+			t.Errorf("Wrong times of %s: %+v", n, rec)
+		}
+	}
+	if rec, _ := state.Record("t2"); rec.ExitCode == nil || *rec.ExitCode != 3 || rec.Signal != "" {
+		t.Errorf("Wrong exit of t2: %+v", rec)
+	}
+	if rec, _ := state.Record("t3"); rec.ExitCode == nil || *rec.ExitCode != 0 || rec.Duration < 0.1 {
+		t.Errorf("Wrong exit of t3: %+v", rec)
+	}
+	if rec, _ := state.Record("t4"); rec.ExitCode != nil || rec.Signal != "terminated" {
+		t.Errorf("Wrong exit of t4: %+v", rec)
+	}
+	if _, ok := state.Record("t1"); ok || !state.IsBlocked("t1") {
+		t.Errorf("Wrong state: %v", state.String())
+	}
+	/* The same command has the same fingerprint */
+	before, _ := state.Record("t2")
+	r.RunTask("t2", testWorkers())
+	if after, _ := r.state.Record("t2"); after.Command != before.Command {
+		t.Errorf("Different fingerprints: %s != %s", after.Command, before.Command)
+	}
+}
+
+func TestState_migration(t *testing.T) {
+	f, err := ioutil.TempFile("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+
+	/* The files without version only had states and attempts */
+	legacy := `{"states": {"t1": "Failure", "t2": "Success"}, "attempts": {"t1": 2}}`
+	if err := ioutil.WriteFile(path, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, err := OpenState(path, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != StateVersion || !state.IsFailure("t1") || !state.IsSuccess("t2") ||
+		state.Attempt("t1") != 2 || state.Attempt("t2") != 0 {
+		t.Errorf("Wrong migration: %v", state.String())
+	}
+	if err := state.Save(); err != nil {
+		t.Fatal(err)
+	}
+	state, err = OpenState(path, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != StateVersion || state.Attempt("t1") != 2 {
+		t.Errorf("Wrong saved state: %v", state.String())
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"version": 99, "states": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenState(path, logger); err == nil || !strings.Contains(err.Error(), "Unsupported state version: 99") {
+		t.Errorf("Expected an unsupported version, not %v", err)
+	}
+}
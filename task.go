@@ -2,11 +2,15 @@ package recipe
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
 	"sync"
+	"syscall"
 )
 
 /*
@@ -15,15 +19,41 @@ import (
  */
 
 type Task struct {
-	Deps         []string          `json:"deps" toml:"deps"`
-	Env          map[string]string `json:"env" toml:"env"`
-	Interp       []string          `json:"interp" toml:"interp"`
-	Cmd          string            `json:"cmd" toml:"cmd"`
-	Stdout       string            `json:"stdout" toml:"stdout"`
-	Stderr       string            `json:"stderr" toml:"stderr"`
-	AllowFailure bool              `json:"allow_failure" toml:"allow_failure"`
-	cmd          *exec.Cmd
-	mu           sync.RWMutex
+	Extends          string              `json:"extends" toml:"extends" yaml:"extends"`
+	Deps             []string            `json:"deps" toml:"deps" yaml:"deps"`
+	After            []string            `json:"after" toml:"after" yaml:"after"`
+	Env              map[string]string   `json:"env" toml:"env" yaml:"env"`
+	Interp           []string            `json:"interp" toml:"interp" yaml:"interp"`
+	Cmd              string              `json:"cmd" toml:"cmd" yaml:"cmd"`
+	Stdout           string              `json:"stdout" toml:"stdout" yaml:"stdout"`
+	Stderr           string              `json:"stderr" toml:"stderr" yaml:"stderr"`
+	AllowFailure     *bool               `json:"allow_failure" toml:"allow_failure" yaml:"allow_failure"`
+	Weight           float64             `json:"weight" toml:"weight" yaml:"weight"`
+	Requires         map[string]int      `json:"requires" toml:"requires" yaml:"requires"`
+	Retries          int                 `json:"retries" toml:"retries" yaml:"retries"`
+	RetryDelay       string              `json:"retry_delay" toml:"retry_delay" yaml:"retry_delay"`
+	RetryBackoff     float64             `json:"retry_backoff" toml:"retry_backoff" yaml:"retry_backoff"`
+	RetryOnExitCodes []int               `json:"retry_on_exit_codes" toml:"retry_on_exit_codes" yaml:"retry_on_exit_codes"`
+	Timeout          string              `json:"timeout" toml:"timeout" yaml:"timeout"`
+	RunIf            string              `json:"run_if" toml:"run_if" yaml:"run_if"`
+	SkipIf           string              `json:"skip_if" toml:"skip_if" yaml:"skip_if"`
+	OnSuccess        []string            `json:"on_success" toml:"on_success" yaml:"on_success"`
+	OnFailure        []string            `json:"on_failure" toml:"on_failure" yaml:"on_failure"`
+	Finally          []string            `json:"finally" toml:"finally" yaml:"finally"`
+	Inputs           []string            `json:"inputs" toml:"inputs" yaml:"inputs"`
+	Outputs          []string            `json:"outputs" toml:"outputs" yaml:"outputs"`
+	Matrix           map[string][]string `json:"matrix" toml:"matrix" yaml:"matrix"`
+	Exclude          []map[string]string `json:"exclude" toml:"exclude" yaml:"exclude"`
+	name             string
+	dir              string
+	pos              position
+	cmdPos           position          // Only when the cmd is in the recipe
+	vars             map[string]string // Variables of its recipe, if it was included or imported
+	imported         bool
+	aggregate        bool // Replaces a matrix task, so it has no cmd on purpose
+	cmd              *exec.Cmd
+	procMu           sync.Mutex
+	mu               sync.RWMutex
 }
 
 /***
@@ -98,12 +128,12 @@ func (t *Task) UnmarshalTOML(b []byte) error {
 
 */
 
-func (t *Task) composeEnv(r *Recipe) []string {
+func (t *Task) composeEnv(et *expandedTask) []string {
 	newEnv := os.Environ()
-	for key, value := range r.Environ() {
+	for key, value := range et.recipeEnv {
 		newEnv = append(newEnv, key+"="+value)
 	}
-	for key, value := range t.Environ() {
+	for key, value := range et.env {
 		newEnv = append(newEnv, key+"="+value)
 	}
 	return newEnv
@@ -117,16 +147,16 @@ func replaceCmd(parts []string, spell string) []string {
 	return newParts
 }
 
-func (t *Task) composeInterpreterCmd(spell string, r *Recipe) []string {
+func (t *Task) composeInterpreterCmd(spell string, et *expandedTask) []string {
 	// Check task config
-	if parts := t.Interpreter(); parts != nil {
+	if parts := et.interp; parts != nil {
 		if len(parts) == 0 {
 			return t.composeDefaultInterpreterCmd(spell)
 		}
 		return replaceCmd(parts, spell)
 	}
 	// Check recipe config
-	if parts := r.Interpreter(); parts != nil {
+	if parts := et.recipeInterp; parts != nil {
 		if len(parts) == 0 {
 			return t.composeDefaultInterpreterCmd(spell)
 		}
@@ -136,15 +166,36 @@ func (t *Task) composeInterpreterCmd(spell string, r *Recipe) []string {
 }
 
 func (t *Task) Execute(r *Recipe) error {
+	return t.ExecuteContext(context.Background(), r)
+}
+
+// ExecuteContext runs the task like Execute, but it is terminated as soon
+// as ctx is done.
+func (t *Task) ExecuteContext(ctx context.Context, r *Recipe) error {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+	return t.executeContext(ctx, r, nil)
+}
+
+/*
+ * Runs the task, copying its stdout and stderr to output if it is given.
+ * The timeout of the task must be already applied to ctx.
+ */
+func (t *Task) executeContext(ctx context.Context, r *Recipe, output *capturedOutput) error {
+	et, err := r.expandTask(t.name, t)
+	if err != nil {
+		return err
+	}
+
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
-	if t.Cmd == "" {
+	if et.cmd == "" {
 		return nil
 	}
 
-	parts := t.composeInterpreterCmd(t.Cmd, r)
-	env := t.composeEnv(r)
+	parts := t.composeInterpreterCmd(et.cmd, et)
+	env := t.composeEnv(et)
 
 	// Search program
 	path, err := exec.LookPath(parts[0])
@@ -152,41 +203,173 @@ func (t *Task) Execute(r *Recipe) error {
 		return err
 	}
 	// Create cmd
-	t.cmd = exec.Command(path, parts[1:]...)
+	cmd := exec.Command(path, parts[1:]...)
 	// Redirect stdout and stderr
-	if t.Stdout != "" {
-		f, err := os.Create(t.Stdout)
+	if et.stdout != "" {
+		f, err := os.Create(et.stdout)
 		if err != nil {
 			return err
 		}
 		defer f.Close()
-		t.cmd.Stdout = f
+		cmd.Stdout = f
 	} else {
-		t.cmd.Stdout = os.Stdout
+		cmd.Stdout = os.Stdout
 	}
-	if t.Stderr != "" {
-		f, err := os.Create(t.Stderr)
+	if et.stderr != "" {
+		f, err := os.Create(et.stderr)
 		if err != nil {
 			return err
 		}
 		defer f.Close()
-		t.cmd.Stderr = f
+		cmd.Stderr = f
 	} else {
-		t.cmd.Stderr = os.Stderr
+		cmd.Stderr = os.Stderr
+	}
+	if output != nil {
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, &output.stdout)
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, &output.stderr)
 	}
-	t.cmd.Env = env
+	cmd.Env = env
 
+	err = t.runProcess(ctx, r, cmd)
+	if cmd.ProcessState != nil {
+		r.state.setExited(t.name, cmd.ProcessState)
+	}
+	return err
+}
+
+/*
+ * Runs a process of the task in its own process group, terminating it as
+ * soon as ctx is done. It is used for the cmd and for the conditions.
+ */
+func (t *Task) runProcess(ctx context.Context, r *Recipe, cmd *exec.Cmd) error {
 	// Set SysProcAttr
-	t.setSysProcAttr()
+	setSysProcAttr(cmd)
 
 	// Run
-	err = t.cmd.Run()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	/* Terminate may be called from other goroutines while starting */
+	t.procMu.Lock()
+	t.cmd = cmd
+	err := cmd.Start()
+	t.procMu.Unlock()
 	if err != nil {
 		return err
 	}
+	exited := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			if err := t.Terminate(); err != nil {
+				r.logger.Error("Unable to terminate '%s': %s", t.name, err.Error())
+			}
+		case <-exited:
+		}
+	}()
+	err = cmd.Wait()
+	/* The process is gone, so it must not be terminated anymore */
+	t.procMu.Lock()
+	t.cmd = nil
+	t.procMu.Unlock()
+	/* Stop the watcher before the deferred cancel makes ctx done */
+	close(exited)
+	<-watched
+	if err != nil {
+		/* Terminated when reaching the timeout or the deadline */
+		if cause := context.Cause(ctx); isTimeout(cause) {
+			return cause
+		}
+		return err
+	}
 	return nil
 }
 
+func (t *Task) clone() *Task {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	c := &Task{
+		Extends:          t.Extends,
+		Deps:             cloneStrings(t.Deps),
+		After:            cloneStrings(t.After),
+		Interp:           cloneStrings(t.Interp),
+		Cmd:              t.Cmd,
+		Stdout:           t.Stdout,
+		Stderr:           t.Stderr,
+		AllowFailure:     t.AllowFailure,
+		Weight:           t.Weight,
+		Requires:         t.Requires,
+		Retries:          t.Retries,
+		RetryDelay:       t.RetryDelay,
+		RetryBackoff:     t.RetryBackoff,
+		RetryOnExitCodes: t.RetryOnExitCodes,
+		Timeout:          t.Timeout,
+		RunIf:            t.RunIf,
+		SkipIf:           t.SkipIf,
+		OnSuccess:        cloneStrings(t.OnSuccess),
+		OnFailure:        cloneStrings(t.OnFailure),
+		Finally:          cloneStrings(t.Finally),
+		Inputs:           cloneStrings(t.Inputs),
+		Outputs:          cloneStrings(t.Outputs),
+		Matrix:           t.Matrix,
+		Exclude:          t.Exclude,
+		name:             t.name,
+		dir:              t.dir,
+		pos:              t.pos,
+		cmdPos:           t.cmdPos,
+		vars:             t.vars,
+		imported:         t.imported,
+		aggregate:        t.aggregate,
+	}
+	if t.Env != nil {
+		c.Env = make(map[string]string, len(t.Env))
+		for k, v := range t.Env {
+			c.Env[k] = v
+		}
+	}
+	return c
+}
+
+/*
+ * Calls terminate with the process of the current execution, if it has not
+ * been waited yet. The lock keeps it from running once Wait returned, and
+ * the process is checked through its handle, which is never confused with a
+ * reused pid, in case it was reaped while taking the lock.
+ */
+func (t *Task) terminateProcess(terminate func(p *os.Process) error) error {
+	t.procMu.Lock()
+	defer t.procMu.Unlock()
+	if t.cmd == nil || t.cmd.Process == nil {
+		return nil
+	}
+	p := t.cmd.Process
+	if err := p.Signal(syscall.Signal(0)); errors.Is(err, os.ErrProcessDone) {
+		return nil
+	}
+	return terminate(p)
+}
+
+/* Keep nil and empty slices apart, as an empty interp is not a missing one */
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append(make([]string, 0, len(s)), s...)
+}
+
+/* A missing AllowFailure is inherited, so it only defaults to false here */
+func (t *Task) allowsFailure() bool {
+	return t.AllowFailure != nil && *t.AllowFailure
+}
+
+// Bool returns a pointer to v, to set AllowFailure when building a Task.
+func Bool(v bool) *bool {
+	return &v
+}
+
 func (t *Task) Environ() map[string]string {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
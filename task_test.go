@@ -0,0 +1,38 @@
+package recipe
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+/* Ending the timeout of a task that already exited must not terminate it */
+func TestTask_noTerminateAfterWait(t *testing.T) {
+	b := bytes.Buffer{}
+	logger := NewLogger("[Test] ")
+	logger.l = log.New(&b, "", 0)
+	r, err := NewRecipe(WithLogger(logger), WithInterp("bash", "-c", "{cmd}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := &Task{Cmd: "true", Timeout: "1h"}
+	if err := r.AddTask("t1", task); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Check(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		if err := r.Tasks["t1"].Execute(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Contains(b.String(), "Unable to terminate") {
+		t.Errorf("Terminated after exiting: %s", b.String())
+	}
+	/* Nothing is left to terminate */
+	if err := r.Tasks["t1"].Terminate(); err != nil {
+		t.Error(err)
+	}
+}
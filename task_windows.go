@@ -11,6 +11,7 @@ package recipe
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
 	"syscall"
 )
@@ -19,31 +20,24 @@ func (t *Task) composeDefaultInterpreterCmd(spell string) []string {
 	return []string{"cmd", "/c", spell}
 }
 
-func (t *Task) setSysProcAttr() {
-	t.cmd.SysProcAttr = &syscall.SysProcAttr{
+func setSysProcAttr(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
 		CreationFlags: syscall.CREATE_UNICODE_ENVIRONMENT | syscall.CREATE_NEW_PROCESS_GROUP,
 	}
 }
 
 func (t *Task) Terminate() error {
-	cmd := t.cmd
-	if cmd == nil {
+	return t.terminateProcess(func(p *os.Process) error {
+		// TODO: Use a better way. Probably using https://github.com/alexbrainman/ps
+		// Search program
+		path, err := exec.LookPath("taskkill")
+		if err != nil {
+			return err
+		}
+		err = exec.Command(path, "/F", "/T", "/PID", fmt.Sprint(p.Pid)).Run()
+		if err != nil {
+			return err
+		}
 		return nil
-	}
-	p := cmd.Process
-	if p == nil {
-		return nil
-	}
-
-	// TODO: Use a better way. Probably using https://github.com/alexbrainman/ps
-	// Search program
-	path, err := exec.LookPath("taskkill")
-	if err != nil {
-		return err
-	}
-	err = exec.Command(path, "/F", "/T", "/PID", fmt.Sprint(p.Pid)).Run()
-	if err != nil {
-		return err
-	}
-	return nil
+	})
 }
@@ -31,4 +31,7 @@ func TestTaskState_EncodeAndDecode(t *testing.T) {
 	_testEncodeAndDecode(t, Cancelled)
 	_testEncodeAndDecode(t, Success)
 	_testEncodeAndDecode(t, Failure)
+	_testEncodeAndDecode(t, Blocked)
+	_testEncodeAndDecode(t, TimedOut)
+	_testEncodeAndDecode(t, Skipped)
 }
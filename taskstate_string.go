@@ -4,9 +4,9 @@ package recipe
 
 import "strconv"
 
-const _TaskState_name = "DisabledEnabledWaitingRunningCancelledSuccessFailure"
+const _TaskState_name = "DisabledEnabledWaitingRunningCancelledSuccessFailureBlockedTimedOutSkipped"
 
-var _TaskState_index = [...]uint8{0, 8, 15, 22, 29, 38, 45, 52}
+var _TaskState_index = [...]uint8{0, 8, 15, 22, 29, 38, 45, 52, 59, 67, 74}
 
 func (i TaskState) String() string {
 	if i < 0 || i >= TaskState(len(_TaskState_index)-1) {
@@ -0,0 +1,86 @@
+package recipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+ * Timeouts
+ *
+ * A task with a timeout is terminated when it runs for longer than that,
+ * and the whole run is stopped when it reaches the deadline of the recipe.
+ * The terminated tasks are marked as TimedOut, and the returned error is a
+ * TimeoutError with the limit that was reached.
+ */
+
+const (
+	TaskTimeout    = "task timeout"
+	RecipeDeadline = "recipe deadline"
+)
+
+// TimeoutError is returned when a task or the whole run takes too long.
+type TimeoutError struct {
+	Limit string
+	After time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("Reached the %s after %s", e.Limit, e.After)
+}
+
+func isTimeout(err error) bool {
+	var timeoutErr *TimeoutError
+	return errors.As(err, &timeoutErr)
+}
+
+/* Durations are written like "1m30s", and can not be negative */
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("Negative duration: %s", s)
+	}
+	return d, nil
+}
+
+// SetDeadline limits how long the next runs can take, instead of the
+// deadline of the recipe. Zero means no limit.
+func (r *Recipe) SetDeadline(d time.Duration) {
+	r.deadline = &d
+}
+
+/* The deadline of the recipe, unless it has been overridden */
+func (r *Recipe) runDeadline() time.Duration {
+	if r.deadline != nil {
+		return *r.deadline
+	}
+	d, _ := parseDuration(r.Deadline)
+	return d
+}
+
+/* The context of a run, cancelled with a TimeoutError at the deadline */
+func (r *Recipe) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	d := r.runDeadline()
+	if d == 0 {
+		return context.WithCancel(ctx)
+	}
+	r.logger.Info("Deadline: %s", d)
+	return context.WithTimeoutCause(ctx, d, &TimeoutError{RecipeDeadline, d})
+}
+
+/* The context of an execution, cancelled with a TimeoutError at the timeout */
+func (t *Task) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	d, _ := parseDuration(t.Timeout)
+	if d == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, d, &TimeoutError{TaskTimeout, d})
+}
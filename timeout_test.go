@@ -0,0 +1,130 @@
+package recipe
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* The tasks that take longer than their timeout are terminated */
+func TestRecipe_timeout(t *testing.T) {
+	txt := `
+main = "t"
+interp = ['bash', '-c', '{cmd}']
+
+[tasks.t]
+deps = ["t1", "t2"]
+
+[tasks.t1]
+timeout = "200ms"
+cmd = "sleep 10"
+
+[tasks.t2]
+timeout = "5s"
+cmd = "true"
+`
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Parse(strings.NewReader(txt), TOML, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = r.RunMain(testWorkers())
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("The task was not terminated: %s", elapsed)
+	}
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Limit != TaskTimeout || timeoutErr.After != 200*time.Millisecond {
+		t.Fatalf("Expected the timeout of t1, not %v", err)
+	}
+	if err.Error() != "(t1) Reached the task timeout after 200ms" {
+		t.Errorf("Wrong message: %s", err)
+	}
+	if !(r.state.IsTimedOut("t1") && r.state.IsSuccess("t2")) {
+		t.Errorf("Wrong state: %v", r.state.String())
+	}
+}
+
+func TestRecipe_deadline(t *testing.T) {
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Parse(strings.NewReader(`
+main = "t"
+interp = ['bash', '-c', '{cmd}']
+deadline = "300ms"
+
+[tasks.t]
+deps = ["t1", "t2"]
+
+[tasks.t1]
+cmd = "sleep 10"
+
+[tasks.t2]
+cmd = "true"
+`), TOML, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = r.RunMain(testWorkers())
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("The run was not stopped: %s", elapsed)
+	}
+	if err == nil || err.Error() != "Reached the recipe deadline after 300ms" {
+		t.Fatalf("Expected the deadline of the recipe, not %v", err)
+	}
+	if !(r.state.IsEnabled("t") && r.state.IsTimedOut("t1") && r.state.IsSuccess("t2")) {
+		t.Errorf("Wrong state: %v", r.state.String())
+	}
+
+	/* The deadline of the recipe can be overridden */
+	r.SetDeadline(100 * time.Millisecond)
+	err = r.RunMain(testWorkers())
+	if err == nil || err.Error() != "Reached the recipe deadline after 100ms" {
+		t.Fatalf("Expected the overridden deadline, not %v", err)
+	}
+}
+
+/* The timeout of a task also covers the evaluation of its conditions */
+func TestRecipe_timeoutConditions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "output")
+	logger := NewLogger("[Test] ")
+	logger.Level = FatalL
+	r, err := Parse(strings.NewReader(`
+main = "t1"
+interp = ['bash', '-c', '{cmd}']
+
+[tasks.t1]
+timeout = "500ms"
+run_if = "sleep 3"
+cmd = "echo t1 >> `+output+`"
+`), TOML, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = r.RunMain(1)
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Limit != TaskTimeout {
+		t.Fatalf("Expected a task timeout, not %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("The condition was not terminated: %s", elapsed)
+	}
+	if !r.state.IsTimedOut("t1") {
+		t.Errorf("Wrong state: %v", r.state.String())
+	}
+	if _, err := os.Stat(output); err == nil {
+		t.Error("The cmd was run after reaching the timeout")
+	}
+}
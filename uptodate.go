@@ -0,0 +1,273 @@
+package recipe
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DisposaBoy/JsonConfigReader"
+)
+
+/*
+ * Up-to-date checks
+ *
+ * A task with outputs is skipped, as make does, when it already ran with
+ * the same command and its outputs are still there and newer than its
+ * inputs. If the inputs were touched, but their content did not change,
+ * the task is skipped too. The inputs and outputs are glob patterns,
+ * relative to the working directory like stdout and stderr, and every
+ * pattern of the outputs must match some file.
+ *
+ * The fingerprints of the command and the content of the inputs of the
+ * last successful run are kept next to the recipe, in a .fingerprints
+ * file. SetForce runs the tasks even if they are up to date.
+ */
+
+const upToDateReason = "up to date"
+
+// SetForce runs the tasks even if their outputs are up to date.
+func (r *Recipe) SetForce(force bool) {
+	r.force = force
+}
+
+func (r *Recipe) Fingerprints() *Fingerprints {
+	return r.fingerprints
+}
+
+func checkPatterns(n, field string, patterns []string) error {
+	for _, p := range patterns {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("In task '%s': Invalid pattern in %s: %s", n, field, p)
+		}
+	}
+	return nil
+}
+
+/*
+ * Returns whether the outputs of the task are up to date. Otherwise it
+ * returns the fingerprint to record if the task succeeds.
+ */
+func (r *Recipe) upToDate(n string, t *Task, et *expandedTask) (bool, *Fingerprint, error) {
+	inputs, err := globFiles(et.inputs)
+	if err != nil {
+		return false, nil, err
+	}
+	fp := &Fingerprint{Command: t.commandFingerprint(et)}
+	last, ok := r.fingerprints.Fingerprint(n)
+	valid := ok && !r.force && last.Command == fp.Command
+	var outputs []string
+	if valid {
+		outputs, valid = existingOutputs(et.outputs)
+	}
+	if valid && newerThan(outputs, inputs) {
+		return true, nil, nil
+	}
+	if fp.Inputs, err = hashFiles(inputs); err != nil {
+		return false, nil, err
+	}
+	if valid && last.Inputs == fp.Inputs {
+		return true, nil, nil
+	}
+	return false, fp, nil
+}
+
+/* Identifies what the task runs, so changing the command runs it again */
+func (t *Task) commandFingerprint(et *expandedTask) string {
+	t.mu.RLock()
+	var cmd []string
+	if et.cmd != "" {
+		cmd = t.composeInterpreterCmd(et.cmd, et)
+	}
+	t.mu.RUnlock()
+	env := make(map[string]string, len(et.recipeEnv)+len(et.env))
+	for k, v := range et.recipeEnv {
+		env[k] = v
+	}
+	for k, v := range et.env {
+		env[k] = v
+	}
+	/* Maps are encoded with sorted keys */
+	b, err := json.Marshal(struct {
+		Cmd     []string          `json:"cmd"`
+		Env     map[string]string `json:"env"`
+		Stdout  string            `json:"stdout"`
+		Stderr  string            `json:"stderr"`
+		Outputs []string          `json:"outputs"`
+	}{cmd, env, et.stdout, et.stderr, et.outputs})
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+/* The sorted files that match the patterns, without duplicates */
+func globFiles(patterns []string) ([]string, error) {
+	files := []string{}
+	for _, p := range patterns {
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern: %s", p)
+		}
+		files = append(files, matches...)
+	}
+	files = uniqueNames(files)
+	sort.Strings(files)
+	return files, nil
+}
+
+/* The outputs, only if every pattern matches some file */
+func existingOutputs(patterns []string) ([]string, bool) {
+	files := []string{}
+	for _, p := range patterns {
+		matches, err := filepath.Glob(p)
+		if err != nil || len(matches) == 0 {
+			return nil, false
+		}
+		files = append(files, matches...)
+	}
+	return files, true
+}
+
+/* Whether the oldest output is newer than the newest input */
+func newerThan(outputs, inputs []string) bool {
+	var newest time.Time
+	for _, f := range inputs {
+		info, err := os.Stat(f)
+		if err != nil {
+			return false
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	for _, f := range outputs {
+		info, err := os.Stat(f)
+		if err != nil || !info.ModTime().After(newest) {
+			return false
+		}
+	}
+	return true
+}
+
+/* Hashes the names and the content of the files */
+func hashFiles(files []string) (string, error) {
+	h := sha256.New()
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00", f)
+		if info.IsDir() {
+			continue
+		}
+		if err := hashFile(h, f); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+/***
+ * Fingerprints
+ */
+
+// Fingerprint identifies the command and the content of the inputs of the
+// last successful run of a task.
+type Fingerprint struct {
+	Command string `json:"command"`
+	Inputs  string `json:"inputs"`
+}
+
+// Fingerprints keeps the fingerprint of the tasks with outputs. They are
+// stored next to the recipe, in path + ".fingerprints", and survive the
+// removal of the state file.
+type Fingerprints struct {
+	Tasks   map[string]*Fingerprint `json:"tasks"`
+	path    string
+	changed bool
+	logger  *Logger
+	mu      sync.RWMutex
+}
+
+// NewFingerprints creates empty fingerprints that are only kept in memory.
+func NewFingerprints(logger *Logger) *Fingerprints {
+	return &Fingerprints{
+		Tasks:  make(map[string]*Fingerprint),
+		logger: logger,
+	}
+}
+
+func OpenFingerprints(path string, logger *Logger) (*Fingerprints, error) {
+	fs := NewFingerprints(logger)
+	f, err := os.Open(path)
+	if err == nil {
+		defer f.Close()
+		err = json.NewDecoder(JsonConfigReader.New(f)).Decode(fs)
+		if err != nil {
+			return nil, fmt.Errorf("(%s) %s", path, err.Error())
+		}
+		if fs.Tasks == nil {
+			fs.Tasks = make(map[string]*Fingerprint)
+		}
+		logger.Debug("Loading fingerprints file: %s", path)
+	}
+	fs.path = path
+	return fs, nil
+}
+
+// Save writes the fingerprints, if any of them changed.
+func (fs *Fingerprints) Save() error {
+	if fs.path == "" {
+		return nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !fs.changed {
+		return nil
+	}
+	b, err := json.MarshalIndent(fs, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(fs.path, append(b, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	fs.changed = false
+	fs.logger.Debug("Saving fingerprints file: %s", fs.path)
+	return nil
+}
+
+func (fs *Fingerprints) Fingerprint(taskName string) (*Fingerprint, bool) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	fp, ok := fs.Tasks[taskName]
+	return fp, ok
+}
+
+func (fs *Fingerprints) SetFingerprint(taskName string, fp *Fingerprint) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.Tasks[taskName] = fp
+	fs.changed = true
+}
@@ -0,0 +1,145 @@
+package recipe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* The tasks whose outputs are newer than their inputs are skipped */
+func TestRecipe_upToDate(t *testing.T) {
+	txt := `
+interp = ['bash', '-c', '{cmd}']
+
+[vars]
+suffix = "!"
+
+[tasks.copy]
+inputs = ["%[1]s/*.in"]
+outputs = ["%[1]s/out.txt"]
+cmd = "cat %[1]s/*.in > %[1]s/out.txt; echo '{suffix}' >> %[1]s/out.txt; echo run >> %[1]s/log"
+`
+	dir, err := ioutil.TempDir("", "uptodate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "a.in")
+	if err := ioutil.WriteFile(input, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	r, err := Parse(strings.NewReader(fmt.Sprintf(txt, dir)), TOML, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := 0
+	run := func(msg string, expected bool) {
+		if err := r.RunTask("copy", testWorkers()); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "log"))
+		ran := strings.Count(string(data), "run") > runs
+		if ran {
+			runs++
+		}
+		if ran != expected {
+			t.Errorf("%s: expected to run %v, not %v", msg, expected, ran)
+		}
+		if !ran && !r.state.IsSkipped("copy") {
+			t.Errorf("%s: expected Skipped, not %s", msg, r.state.States["copy"])
+		}
+	}
+	later := func(path string) {
+		future := time.Now().Add(time.Hour)
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run("First run", true)
+	run("Nothing changed", false)
+	/* Touched, but with the same content */
+	later(input)
+	run("Touched input", false)
+	if err := ioutil.WriteFile(input, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later(input)
+	run("Changed input", true)
+	if err := ioutil.WriteFile(filepath.Join(dir, "c.in"), []byte("c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run("New input", true)
+	r.SetVar("suffix", "?")
+	run("Changed command", true)
+	os.Remove(filepath.Join(dir, "out.txt"))
+	run("Removed output", true)
+	r.SetForce(true)
+	run("Forced", true)
+	r.SetForce(false)
+	run("Not forced", false)
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "out.txt")); string(data) != "bc?\n" {
+		t.Errorf("Invalid output: %q", data)
+	}
+}
+
+func TestRecipe_upToDateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uptodate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, err := TmpRecipe("toml", fmt.Sprintf(`
+main = "t1"
+interp = ['bash', '-c', '{cmd}']
+
+[tasks.t1]
+outputs = ["%[1]s/out.txt"]
+cmd = "echo run >> %[1]s/out.txt"
+`, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+	defer os.Remove(path + ".fingerprints")
+
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	/* The fingerprints survive the removal of the state file */
+	for i := 0; i < 2; i++ {
+		r, err := Open(path, logger, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.RunMain(testWorkers()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path + ".fingerprints"); err != nil {
+		t.Error(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "out.txt")); string(data) != "run\n" {
+		t.Errorf("Invalid output: %q", data)
+	}
+}
+
+func TestRecipe_upToDateCheck(t *testing.T) {
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	_, err := Parse(strings.NewReader(`
+[tasks.t1]
+outputs = ["out[.txt"]
+cmd = "true"
+`), TOML, logger, logger)
+	if err == nil || err.Error() != "2:1: In task 't1': Invalid pattern in outputs: out[.txt" {
+		t.Errorf("Expected an invalid pattern, not %v", err)
+	}
+}
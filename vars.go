@@ -0,0 +1,280 @@
+package recipe
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * Variables
+ *
+ * Placeholders like {name} are replaced by the value of the variable name
+ * in the cmd, env, interp, stdout, stderr and conditions of the tasks. Variable values
+ * may contain placeholders too. {{name}} is left as {name}, and shell
+ * expansions like ${name} are never touched. {cmd} is reserved to the
+ * interpreters, so it is only replaced when the command is composed.
+ */
+
+var varNameRegexp = regexp.MustCompile(`^[A-Za-z_]\w*$`)
+
+var placeholderRegexp = regexp.MustCompile(`\{\{([A-Za-z_]\w*)\}\}|\$\{[^}]*\}|\{([A-Za-z_]\w*)\}`)
+
+/* Builtin variables */
+const (
+	taskVar      = "task"
+	recipeDirVar = "recipe_dir"
+	runIDVar     = "run_id"
+	cmdVar       = "cmd"
+)
+
+func isBuiltinVar(name string) bool {
+	switch name {
+	case taskVar, recipeDirVar, runIDVar, cmdVar:
+		return true
+	}
+	return false
+}
+
+// SetVar overrides the value of a variable of the recipe, and of the
+// recipes it imports.
+func (r *Recipe) SetVar(name, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Vars == nil {
+		r.Vars = make(map[string]string)
+	}
+	r.Vars[name] = value
+	if r.overrides == nil {
+		r.overrides = make(map[string]string)
+	}
+	r.overrides[name] = value
+}
+
+func (r *Recipe) Variables() map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.Vars
+}
+
+/* The variables of the task, which are the ones of the recipe unless it was imported or included */
+func (r *Recipe) taskVars(t *Task) map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if t.vars == nil {
+		return r.Vars
+	}
+	vars := make(map[string]string, len(t.vars)+len(r.Vars))
+	for k, v := range t.vars {
+		vars[k] = v
+	}
+	overrides := r.Vars
+	if t.imported {
+		overrides = r.overrides
+	}
+	for k, v := range overrides {
+		vars[k] = v
+	}
+	return vars
+}
+
+/* The process environment overrides the variables declared in the recipes */
+func (r *Recipe) overrideVarsFromEnv() {
+	override := func(vars map[string]string) {
+		for n := range vars {
+			if v, ok := os.LookupEnv(n); ok {
+				vars[n] = v
+			}
+		}
+	}
+	override(r.Vars)
+	for _, t := range r.Tasks {
+		override(t.vars)
+	}
+}
+
+func (r *Recipe) checkVars(c *checker) {
+	names := make([]string, 0, len(r.Vars))
+	for n := range r.Vars {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if isBuiltinVar(n) {
+			c.key("vars", fmt.Errorf("Reserved variable name: %s", n))
+		}
+	}
+	for _, n := range r.taskNames() {
+		for v := range r.Tasks[n].vars {
+			if _, ok := r.Vars[v]; !ok && isBuiltinVar(v) {
+				c.task(n, fmt.Errorf("In task '%s': Reserved variable name: %s", n, v))
+			}
+		}
+		if _, err := r.expandTask(n, r.Tasks[n]); err != nil {
+			c.task(n, fmt.Errorf("In task '%s': %s", n, err.Error()))
+		}
+	}
+}
+
+func newRunID() string {
+	return time.Now().UTC().Format("20060102T150405.000000000Z")
+}
+
+/* The fields of a task after replacing its variables */
+type expandedTask struct {
+	cmd          string
+	env          map[string]string
+	recipeEnv    map[string]string
+	interp       []string
+	recipeInterp []string
+	stdout       string
+	stderr       string
+	runIf        string
+	skipIf       string
+	inputs       []string
+	outputs      []string
+	vars         *varExpander
+}
+
+func (r *Recipe) expandTask(name string, t *Task) (*expandedTask, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	dir := t.dir
+	if dir == "" {
+		dir = r.dir
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	r.mu.RLock()
+	builtins := map[string]string{
+		taskVar:      name,
+		recipeDirVar: dir,
+		runIDVar:     r.runID,
+		cmdVar:       "{" + cmdVar + "}",
+	}
+	r.mu.RUnlock()
+	e := &varExpander{r.taskVars(t), builtins, nil}
+
+	var err error
+	et := &expandedTask{}
+	if et.cmd, err = e.expand(t.Cmd); err != nil {
+		return nil, err
+	}
+	if et.env, err = e.expandMap(t.Env); err != nil {
+		return nil, err
+	}
+	if et.recipeEnv, err = e.expandMap(r.Environ()); err != nil {
+		return nil, err
+	}
+	if et.interp, err = e.expandSlice(t.Interp); err != nil {
+		return nil, err
+	}
+	if et.recipeInterp, err = e.expandSlice(r.Interpreter()); err != nil {
+		return nil, err
+	}
+	if et.stdout, err = e.expand(t.Stdout); err != nil {
+		return nil, err
+	}
+	if et.stderr, err = e.expand(t.Stderr); err != nil {
+		return nil, err
+	}
+	if et.inputs, err = e.expandSlice(t.Inputs); err != nil {
+		return nil, err
+	}
+	if et.outputs, err = e.expandSlice(t.Outputs); err != nil {
+		return nil, err
+	}
+	/* The expressions use vars.name instead of placeholders */
+	et.runIf, et.skipIf = t.RunIf, t.SkipIf
+	if !isExpression(t.RunIf) {
+		if et.runIf, err = e.expand(t.RunIf); err != nil {
+			return nil, err
+		}
+	}
+	if !isExpression(t.SkipIf) {
+		if et.skipIf, err = e.expand(t.SkipIf); err != nil {
+			return nil, err
+		}
+	}
+	et.vars = e
+	return et, nil
+}
+
+type varExpander struct {
+	vars     map[string]string
+	builtins map[string]string
+	stack    []string
+}
+
+func (e *varExpander) expand(s string) (string, error) {
+	var err error
+	result := placeholderRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		if err != nil {
+			return m
+		}
+		sub := placeholderRegexp.FindStringSubmatch(m)
+		if sub[1] != "" {
+			/* Escaped placeholder */
+			return "{" + sub[1] + "}"
+		}
+		if sub[2] == "" {
+			/* Shell expansion */
+			return m
+		}
+		var v string
+		v, err = e.lookup(sub[2])
+		return v
+	})
+	return result, err
+}
+
+func (e *varExpander) lookup(name string) (string, error) {
+	if v, ok := e.builtins[name]; ok {
+		return v, nil
+	}
+	v, ok := e.vars[name]
+	if !ok {
+		return "", fmt.Errorf("Undefined variable: %s", name)
+	}
+	for _, n := range e.stack {
+		if n == name {
+			return "", fmt.Errorf("Recursive variable: %s", strings.Join(append(e.stack, name), " -> "))
+		}
+	}
+	e.stack = append(e.stack, name)
+	defer func() { e.stack = e.stack[:len(e.stack)-1] }()
+	return e.expand(v)
+}
+
+func (e *varExpander) expandMap(m map[string]string) (map[string]string, error) {
+	if m == nil {
+		return nil, nil
+	}
+	expanded := make(map[string]string, len(m))
+	for k, v := range m {
+		var err error
+		if expanded[k], err = e.expand(v); err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
+
+func (e *varExpander) expandSlice(s []string) ([]string, error) {
+	if s == nil {
+		return nil, nil
+	}
+	expanded := make([]string, len(s))
+	for i, v := range s {
+		var err error
+		if expanded[i], err = e.expand(v); err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
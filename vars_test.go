@@ -0,0 +1,91 @@
+package recipe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+/* The placeholders of the tasks are replaced by the variables */
+func TestRecipe_vars(t *testing.T) {
+	txt := `
+main = "t1"
+interp = ['{shell}', '-c', 'exec {cmd}']
+
+[vars]
+shell = "bash"
+who = "world"
+greeting = "hi {who}"
+out = "%[1]s"
+
+[tasks.t1]
+deps = ["t2"]
+env = {GREETING = "{greeting}"}
+cmd = "echo $GREETING from {task} >> {out}"
+
+[tasks.t2]
+env = {X = "shell"}
+cmd = "echo {{task}} ${X} {run_id} >> {out}"
+`
+	/* Create tmp file */
+	name := "vars_output.txt"
+	defer os.Remove(name)
+
+	/* Create recipe with tmp file */
+	path, err := TmpRecipe("toml", fmt.Sprintf(txt, name))
+	if err != nil {
+		t.Errorf("Writing recipe: %s", err)
+		return
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".state")
+	defer os.Remove(path + ".timings")
+
+	/* Run recipe overriding variables */
+	os.Setenv("who", "everybody")
+	defer os.Unsetenv("who")
+	logger := NewLogger("[Test] ")
+	logger.Level = WarningL
+	r, err := Open(path, logger, logger)
+	if err != nil {
+		t.Errorf("Loading recipe: %s", err)
+		return
+	}
+	r.SetVar("greeting", "hello {who}")
+	err = r.RunMain(testWorkers())
+	if err != nil {
+		t.Errorf("Running recipe: %s", err)
+		return
+	}
+
+	/* Check tmp file */
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Errorf("Reading output: %s", err)
+		return
+	}
+	lines := strings.Split(string(data), "\n")
+	if !(len(lines) == 3 && strings.HasPrefix(lines[0], "{task} shell ") && len(lines[0]) > len("{task} shell ") &&
+		lines[1] == "hello everybody from t1" && lines[2] == "") {
+		t.Errorf("Invalid data: %s", data)
+	}
+}
+
+func TestRecipe_varsUndefined(t *testing.T) {
+	logger := NewLogger("[Test] ")
+	logger.Level = ErrorL
+	_, err := Parse(strings.NewReader(`
+main = "t1"
+
+[vars]
+a = "{b}"
+
+[tasks.t1]
+stdout = "{a}"
+`), TOML, logger, logger)
+	if err == nil || err.Error() != "7:1: In task 't1': Undefined variable: b" {
+		t.Errorf("Expected undefined variable, not %v", err)
+	}
+}